@@ -47,7 +47,15 @@ func PreInit() {
 }
 
 func PostInit() {
+	startSessionStore()
 	ResetAllSession()
+	startUploadExpiry()
+	startDownloadExpiry()
+	startTelemetry()
+	startCommandChecks()
+	startLogRetention()
+	startMQTT()
+	startRateLimitStats()
 }
 
 func initWebsocket() {
@@ -79,6 +87,7 @@ func initWebsocket() {
 		/dataset/call_kw/*path
 		/dataset/search_read
 		/dataset/call_button
+		execute_batch
 
 	*/
 	root := controllers.Registry
@@ -87,6 +96,7 @@ func initWebsocket() {
 		jsonHexya.RegisterMethod("version", JsonRPCVersionInfo)
 		jsonHexya.RegisterMethod("login", JsonRPCLogin)
 		jsonHexya.RegisterMethod("logout", JsonRPCLogout)
+		jsonHexya.RegisterMethod("resume", JsonRPCResume)
 
 		jsonHexya.RegisterMethod("locale", nil)
 		jsonHexya.RegisterMethod("session", JsonRPCSessionInfo) // Session info, locale, modules, token
@@ -102,9 +112,32 @@ func initWebsocket() {
 		jsonHexya.RegisterMethod("call_kw", JsonRPCCallKW)
 		jsonHexya.RegisterMethod("search_read", JsonRPCSearchRead)
 		jsonHexya.RegisterMethod("call_button", JsonRPCCallButton)
+		jsonHexya.RegisterMethod("execute_batch", JsonRPCExecuteBatch)
+
+		jsonHexya.RegisterMethod("subscribe", JsonRPCSubscribe)
+		jsonHexya.RegisterMethod("unsubscribe", JsonRPCUnsubscribe)
+		jsonHexya.RegisterMethod("presence", JsonRPCPresence)
+
+		jsonHexya.RegisterMethod("upload_begin", JsonRPCUploadBegin)
+		jsonHexya.RegisterMethod("upload_cancel", JsonRPCUploadCancel)
+		jsonHexya.RegisterMethod("download", JsonRPCDownload)
+		jsonHexya.RegisterMethod("download_report", JsonRPCDownloadReport)
+		jsonHexya.RegisterMethod("download_ack", JsonRPCDownloadAck)
+		jsonHexya.RegisterMethod("download_cancel", JsonRPCDownloadCancel)
 
 		jsonHexya.RegisterMethod("token", JsonRPCToken) // New Token
 
+		jsonHexya.RegisterMethod("device_login", JsonRPCDeviceLogin)
+		jsonHexya.RegisterMethod("device_token", JsonRPCDeviceToken)
+		jsonHexya.RegisterMethod("telemetry", JsonRPCTelemetry)
+		jsonHexya.RegisterMethod("telemetry_query", JsonRPCTelemetryQuery)
+		jsonHexya.RegisterMethod("device_command", JsonRPCDeviceCommand)
+		jsonHexya.RegisterMethod("shadow_report", JsonRPCShadowReport)
+		jsonHexya.RegisterMethod("shadow_desire", JsonRPCShadowDesire)
+		jsonHexya.RegisterMethod("shadow_get", JsonRPCShadowGet)
+		jsonHexya.RegisterMethod("firmware_download", JsonRPCFirmwareDownload)
+		jsonHexya.RegisterMethod("firmware_status", JsonRPCFirmwareStatus)
+
 		jsonHexya.RegisterResponser("ping", JsonRPCHandleResponsePing)
 
 		root.AddController(http.MethodGet, "/jsonrpc", MakeHandleFunc(jsonHexya))
@@ -0,0 +1,39 @@
+package websocket
+
+import (
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+)
+
+// canReadModel returns true if the given user has the read access right on
+// the model with the given name
+func canReadModel(uid int64, model string) bool {
+	if uid == security.SuperUserID {
+		return true
+	}
+	if _, ok := models.Registry.Get(model); !ok {
+		return false
+	}
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		rc := env.Pool(model)
+		rc.Call("Search", rc.Model().Field("ID").Equals(0)).(models.RecordSet).Collection().Call("SearchCount")
+	})
+	return err == nil
+}
+
+// canReadRecord returns true if the given user can read the record with the
+// given ID of model, taking access rights and record rules into account.
+func canReadRecord(uid int64, model string, id int64) bool {
+	if uid == security.SuperUserID {
+		return true
+	}
+	if _, ok := models.Registry.Get(model); !ok {
+		return false
+	}
+	var count int
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		rc := env.Pool(model)
+		count = rc.Call("Search", rc.Model().Field("ID").Equals(id)).(models.RecordSet).Collection().Call("SearchCount").(int)
+	})
+	return err == nil && count == 1
+}
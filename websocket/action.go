@@ -2,9 +2,11 @@ package websocket
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
+	"hash/fnv"
 
 	"github.com/hexya-erp/hexya/src/actions"
+	"github.com/hexya-erp/hexya/src/menus"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types"
@@ -32,45 +34,154 @@ func JsonRPCMenuLoadNeedaction(s *melody.Session, r *server.RequestRPC) (interfa
 */
 
 // URL: /action/load
-// ActionLoad returns the action with the given id
+// ActionLoad returns the action with the given external or numeric ID.
 func JsonRPCActionLoad(s *Session, r *RequestRPC) (interface{}, error) {
-	var uid int64
-	var lang string
-	//uidtmp, exist := s.Get("uid")
-	uid = s.UID
-	if uid > 0 {
-		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
-			user := h.User().Search(env, q.User().ID().Equals(uid))
-			lang = user.ContextGet().GetString("lang")
-		})
+	uid := s.UID
+	if uid == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, "Access denied", nil), nil
 	}
 
 	params := struct {
-		ActionID          string         `json:"action_id"`
-		AdditionalContext *types.Context `json:"additional_context"`
+		ActionID          json.RawMessage `json:"action_id"`
+		AdditionalContext *types.Context  `json:"additional_context"`
 	}{}
-
+	if r.Params == nil {
+		return NewResponseError(r, ErrorCodeInvalidParams, "JsonRPCActionLoad error: Invalid format", nil), nil
+	}
 	err := json.Unmarshal(*r.Params, &params)
 	if err != nil {
+		return NewResponseError(r, ErrorCodeInvalidParams, "JsonRPCActionLoad error: Invalid format", nil), nil
+	}
 
+	act := findAction(params.ActionID)
+	if act == nil {
+		return NewResponseError(r, ErrorCodeNotFound, "Action not found: "+string(params.ActionID), nil), nil
+	}
+	if !canAccessAction(uid, act) {
+		return NewResponseError(r, ErrorCodeAccessDenied, "Access denied", nil), nil
+	}
+
+	action := translatedAction(*act, userLang(uid))
+	if params.AdditionalContext != nil {
+		ctx := make(map[string]interface{})
+		if action.Context != nil {
+			for k, v := range action.Context.ToMap() {
+				ctx[k] = v
+			}
+		}
+		for k, v := range params.AdditionalContext.ToMap() {
+			ctx[k] = v
+		}
+		action.Context = types.NewContext(ctx)
 	}
-	action := *actions.Registry.MustGetById(params.ActionID)
-	action.Name = action.TranslatedName(lang)
 	response := &server.ResponseRPC{
 		JsonRPC: r.JsonRPC,
 		ID:      r.ID,
-		Result:  &action,
+		Result:  action,
 	}
 	return response, nil
 }
 
+// findAction returns the action referenced by the given JSON value, which
+// is either its external ID string or its numeric ID. It returns nil if no
+// such action exists.
+func findAction(raw json.RawMessage) *actions.Action {
+	var xmlID string
+	if err := json.Unmarshal(raw, &xmlID); err == nil {
+		return actions.Registry.GetById(xmlID)
+	}
+	var id int64
+	if err := json.Unmarshal(raw, &id); err != nil || id <= 0 {
+		return nil
+	}
+	for _, action := range actions.Registry.GetAll() {
+		if ActionNumericID(action.ID) == id {
+			return action
+		}
+	}
+	return nil
+}
+
+// ActionNumericID returns the numeric ID of the action with the given
+// external ID. Actions are not stored in the database, so their numeric ID
+// is a hash of their external ID, which does not change when actions are
+// added or removed. It fits in 53 bits so that Javascript clients can use
+// it.
+func ActionNumericID(xmlID string) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(xmlID))
+	return int64(hash.Sum64() & (1<<53 - 1))
+}
+
+// canAccessAction returns true if the given user may load action.
+//
+// The user must be allowed to see one of the menus of the action and all of
+// its parents. Actions that are not referenced by any menu, such as the
+// actions of buttons, require the read access right on their model, which
+// is granted by groups. Other actions are denied.
+func canAccessAction(uid int64, action *actions.Action) bool {
+	if uid == security.SuperUserID {
+		return true
+	}
+	var referenced, allowed bool
+	var walk func(items []*menus.Menu)
+	walk = func(items []*menus.Menu) {
+		for _, m := range items {
+			if m.ActionID == action.ID || (m.Action != nil && m.Action.ID == action.ID) {
+				referenced = true
+				if canAccessMenu(uid, m) {
+					allowed = true
+					return
+				}
+			}
+			if m.HasChildren && m.Children != nil {
+				walk(m.Children.Menus)
+			}
+			if allowed {
+				return
+			}
+		}
+	}
+	walk(menus.Registry.Menus)
+	if allowed {
+		return true
+	}
+	if referenced || action.Model == "" {
+		return false
+	}
+	return canReadModel(uid, action.Model)
+}
+
+// canAccessMenu returns true if the given user belongs to one of the groups
+// of the menu and of each of its parents. Menus without groups are visible
+// to every user.
+func canAccessMenu(uid int64, menu *menus.Menu) bool {
+	for m := menu; m != nil; m = m.Parent {
+		if len(m.Groups) == 0 {
+			continue
+		}
+		var member bool
+		for group := range m.Groups {
+			if security.Registry.HasMembership(uid, group) {
+				member = true
+				break
+			}
+		}
+		if !member {
+			return false
+		}
+	}
+	return true
+}
+
 // URL: /action/run
-// ActionRun runs the given server action
+// ActionRun runs the given server action and returns the resulting action
+// or false if there is none.
 func JsonRPCActionRun(s *Session, r *RequestRPC) (interface{}, error) {
 
 	uid := s.UID
 	if uid == 0 {
-		return nil, errors.New("Access denied")
+		return NewResponseError(r, ErrorCodeAccessDenied, "Access denied", nil), nil
 	}
 
 	params := struct {
@@ -78,23 +189,32 @@ func JsonRPCActionRun(s *Session, r *RequestRPC) (interface{}, error) {
 		Context  *types.Context `json:"context"`
 	}{}
 
+	if r.Params == nil {
+		return NewResponseError(r, ErrorCodeInvalidParams, "JsonRPCActionRun error: Invalid format", nil), nil
+	}
 	err := json.Unmarshal(*r.Params, &params)
 	if err != nil {
-		return nil, errors.New("JsonRPCActionRun error: Invalid format")
+		return NewResponseError(r, ErrorCodeInvalidParams, "JsonRPCActionRun error: Invalid format", nil), nil
+	}
+	action := actions.Registry.GetById(params.ActionID)
+	if action == nil {
+		return NewResponseError(r, ErrorCodeNotFound, "Action not found: "+params.ActionID, nil), nil
+	}
+	if !canAccessAction(uid, action) {
+		return NewResponseError(r, ErrorCodeAccessDenied, "Access denied", nil), nil
+	}
+	if params.Context == nil {
+		params.Context = types.NewContext()
 	}
-	action := actions.Registry.MustGetById(params.ActionID)
 
 	// Process context ids into args
-	var ids []int64
-	if params.Context.Get("active_ids") != nil {
-		ids = params.Context.Get("active_ids").([]int64)
-	} else if params.Context.Get("active_id") != nil {
-		ids = []int64{params.Context.Get("active_id").(int64)}
+	ids, err := contextIDs(params.Context)
+	if err != nil {
+		return NewResponseError(r, ErrorCodeInvalidParams, "JsonRPCActionRun error: "+err.Error(), nil), nil
 	}
 	idsJSON, err := json.Marshal(ids)
 	if err != nil {
-		//log.Panic("Unable to marshal ids")
-		return nil, err
+		return NewExecutionError(s, r, err), nil
 	}
 
 	// Process context into kwargs
@@ -103,23 +223,99 @@ func JsonRPCActionRun(s *Session, r *RequestRPC) (interface{}, error) {
 	kwargs["context"] = contextJSON
 
 	// Execute the function
-	resAction, _ := controllers.Execute(uid, controllers.CallParams{
+	resAction, err := controllers.Execute(uid, controllers.CallParams{
 		Model:  action.Model,
 		Method: action.Method,
 		Args:   []json.RawMessage{idsJSON},
 		KWArgs: kwargs,
 	})
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+
+	var result interface{} = false
+	switch act := resAction.(type) {
+	case *actions.Action:
+		if act != nil {
+			result = translatedAction(*act, userLang(uid))
+		}
+	case actions.Action:
+		result = translatedAction(act, userLang(uid))
+	}
+	response := &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  result,
+	}
+	return response, nil
+}
+
+// contextIDs returns the IDs given by the active_ids or active_id keys of
+// the context. IDs decoded from JSON are float64 values.
+func contextIDs(ctx *types.Context) ([]int64, error) {
+	if value := ctx.Get("active_ids"); value != nil {
+		switch v := value.(type) {
+		case []int64:
+			return v, nil
+		case []interface{}:
+			ids := make([]int64, len(v))
+			for i, item := range v {
+				id, ok := toID(item)
+				if !ok {
+					return nil, fmt.Errorf("invalid active_ids: %v", value)
+				}
+				ids[i] = id
+			}
+			return ids, nil
+		default:
+			return nil, fmt.Errorf("invalid active_ids: %v", value)
+		}
+	}
+	if value := ctx.Get("active_id"); value != nil {
+		id, ok := toID(value)
+		if !ok {
+			return nil, fmt.Errorf("invalid active_id: %v", value)
+		}
+		return []int64{id}, nil
+	}
+	return nil, nil
+}
 
-	if _, ok := resAction.(*actions.Action); ok {
-		//c.RPC(http.StatusOK, resAction)
-		response := &server.ResponseRPC{
-			JsonRPC: r.JsonRPC,
-			ID:      r.ID,
-			Result:  "success",
+// toID returns the record ID given by value, which must be an integer
+func toID(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case float64:
+		if v != float64(int64(v)) {
+			return 0, false
 		}
-		return response, nil
-	} else {
-		//c.RPC(http.StatusOK, false)
-		return nil, errors.New("Not action")
+		return int64(v), true
+	case json.Number:
+		id, err := v.Int64()
+		return id, err == nil
+	}
+	return 0, false
+}
+
+// userLang returns the language of the given user
+func userLang(uid int64) string {
+	var lang string
+	if uid == 0 {
+		return lang
 	}
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		user := h.User().Search(env, q.User().ID().Equals(uid))
+		lang = user.ContextGet().GetString("lang")
+	})
+	return lang
+}
+
+// translatedAction returns a copy of the given action with its name
+// translated in lang.
+func translatedAction(action actions.Action, lang string) *actions.Action {
+	action.Name = action.TranslatedName(lang)
+	return &action
 }
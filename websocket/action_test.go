@@ -0,0 +1,82 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/hexya-erp/hexya/src/actions"
+	"github.com/hexya-erp/hexya/src/models/types"
+)
+
+func TestContextIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		context string
+		ids     []int64
+		err     bool
+	}{
+		{"empty", `{}`, nil, false},
+		{"active_ids", `{"active_ids": [3, 5]}`, []int64{3, 5}, false},
+		{"active_id", `{"active_id": 7}`, []int64{7}, false},
+		{"active_ids first", `{"active_ids": [1], "active_id": 2}`, []int64{1}, false},
+		{"empty active_ids", `{"active_ids": []}`, []int64{}, false},
+		{"not a list", `{"active_ids": "1,2"}`, nil, true},
+		{"not integers", `{"active_ids": [1.5]}`, nil, true},
+		{"string id", `{"active_id": "7"}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := new(types.Context)
+			if err := json.Unmarshal([]byte(tt.context), ctx); err != nil {
+				t.Fatal(err)
+			}
+			ids, err := contextIDs(ctx)
+			if (err != nil) != tt.err {
+				t.Fatalf("contextIDs() error = %v, want error %v", err, tt.err)
+			}
+			if !tt.err && !reflect.DeepEqual(ids, tt.ids) {
+				t.Errorf("contextIDs() = %v, want %v", ids, tt.ids)
+			}
+		})
+	}
+}
+
+func TestContextIDsInt64(t *testing.T) {
+	ctx := types.NewContext().WithKey("active_ids", []int64{4, 2})
+	ids, err := contextIDs(ctx)
+	if err != nil || !reflect.DeepEqual(ids, []int64{4, 2}) {
+		t.Errorf("contextIDs() = %v, %v, want [4 2]", ids, err)
+	}
+}
+
+func TestFindAction(t *testing.T) {
+	action := &actions.Action{ID: "websocket_test_action", Name: "Test"}
+	actions.Registry.Add(action)
+	id := ActionNumericID(action.ID)
+	if id <= 0 || id >= 1<<53 {
+		t.Fatalf("ActionNumericID() = %d, want a positive 53-bit ID", id)
+	}
+	tests := []struct {
+		name string
+		raw  string
+		want *actions.Action
+	}{
+		{"external id", `"websocket_test_action"`, action},
+		{"numeric id", fmt.Sprintf("%d", id), action},
+		{"unknown external id", `"websocket_unknown_action"`, nil},
+		{"unknown numeric id", fmt.Sprintf("%d", id+1), nil},
+		{"zero", `0`, nil},
+		{"negative", fmt.Sprintf("%d", -id), nil},
+		{"float", `1.5`, nil},
+		{"object", `{"id": 1}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findAction(json.RawMessage(tt.raw)); got != tt.want {
+				t.Errorf("findAction(%s) = %v, want %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
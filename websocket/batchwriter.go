@@ -0,0 +1,101 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+)
+
+// A batchWriter accumulates items and writes them together, either when
+// the batch is full or periodically, so that frequent writes do not cost
+// one database round trip each.
+type batchWriter struct {
+	mutex      sync.Mutex
+	flushMutex sync.Mutex
+	items      []interface{}
+	size       int
+	write      func(items []interface{})
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+// newBatchWriter returns a batchWriter calling write with at most size items
+// at a time, at least every interval.
+func newBatchWriter(size int, interval time.Duration, write func(items []interface{})) *batchWriter {
+	bw := &batchWriter{
+		size:  size,
+		write: write,
+		stop:  make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				bw.Flush()
+			case <-bw.stop:
+				return
+			}
+		}
+	}()
+	return bw
+}
+
+// Add queues an item for writing. The batch is written in the background
+// as soon as it is full.
+func (bw *batchWriter) Add(item interface{}) {
+	bw.mutex.Lock()
+	bw.items = append(bw.items, item)
+	full := len(bw.items) >= bw.size
+	bw.mutex.Unlock()
+	if full {
+		go bw.Flush()
+	}
+}
+
+// Len returns the number of queued items
+func (bw *batchWriter) Len() int {
+	bw.mutex.Lock()
+	defer bw.mutex.Unlock()
+	return len(bw.items)
+}
+
+// Flush writes all the queued items
+func (bw *batchWriter) Flush() {
+	bw.flushMutex.Lock()
+	defer bw.flushMutex.Unlock()
+	for {
+		bw.mutex.Lock()
+		items := bw.items
+		if len(items) > bw.size {
+			items = items[:bw.size]
+			bw.items = bw.items[bw.size:]
+		} else {
+			bw.items = nil
+		}
+		bw.mutex.Unlock()
+		if len(items) == 0 {
+			return
+		}
+		bw.safeWrite(items)
+	}
+}
+
+// safeWrite calls the write function and logs its panics so that a failing
+// batch does not stop the writer.
+func (bw *batchWriter) safeWrite(items []interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warn("Batch write failed", "items", len(items), "error", r)
+		}
+	}()
+	bw.write(items)
+}
+
+// Close stops the periodic writes and writes the queued items
+func (bw *batchWriter) Close() {
+	bw.stopOnce.Do(func() {
+		close(bw.stop)
+	})
+	bw.Flush()
+}
@@ -0,0 +1,115 @@
+package websocket
+
+import (
+	"encoding/json"
+
+	"github.com/oklog/ulid"
+)
+
+const (
+	// ClockDriftTopic is the topic of the clock_drift notifications, sent
+	// when the clock of a device drifts beyond the threshold of the service
+	ClockDriftTopic = "clock_drift"
+	// clockSmoothing is the weight of a new sample in the clock estimates
+	clockSmoothing = 0.25
+)
+
+// ClockDrift is the params of the clock_drift notification
+type ClockDrift struct {
+	Service     string `json:"service"`
+	Session     string `json:"session"`
+	Device      string `json:"device"`
+	ClockOffset int64  `json:"clock_offset"`
+	Latency     int64  `json:"latency"`
+	Epoch       int64  `json:"epoch"`
+}
+
+// A connectionClock is the clock estimate of a connection to write
+type connectionClock struct {
+	id          int64
+	clockOffset int64
+	latency     int64
+}
+
+// Ping sends a ping request to the client of the session. The answer of the
+// client, which carries its epoch, updates the clock offset and the latency
+// of the session. No ping is sent while the previous one is waiting for
+// its answer.
+func (s *Session) Ping() error {
+	s.mutex.Lock()
+	previous := s.pingID
+	s.mutex.Unlock()
+	if previous != 0 && s.waiting(previous) {
+		return nil
+	}
+	sent := int64(ulid.Now())
+	params := map[string]interface{}{"epoch": sent}
+	id, err := s.Call("ping", params, func(s *Session, response *ResponseRPC) {
+		s.pingAnswered(sent, int64(ulid.Now()), response)
+		JsonRPCHandleResponsePing(s, response)
+	})
+	if err == nil {
+		s.mutex.Lock()
+		s.pingID = id
+		s.mutex.Unlock()
+	}
+	return err
+}
+
+// pingAnswered updates the clock estimates of the session with the answer
+// to a ping sent at sent and received at received. The offset is the time
+// of the client minus the time of the server, assuming the answer was sent
+// halfway through the round trip.
+func (s *Session) pingAnswered(sent, received int64, response *ResponseRPC) {
+	if response.Result == nil {
+		return
+	}
+	var params JSONRPCGenericParams
+	if err := json.Unmarshal(*response.Result, &params); err != nil || params.Epoch == 0 {
+		return
+	}
+	latency := received - sent
+	offset := params.Epoch - (sent+received)/2
+	s.mutex.Lock()
+	if s.clockSamples == 0 {
+		s.ClockOffset = offset
+		s.Latency = latency
+	} else {
+		s.ClockOffset += int64(clockSmoothing * float64(offset-s.ClockOffset))
+		s.Latency += int64(clockSmoothing * float64(latency-s.Latency))
+	}
+	s.clockSamples++
+	offset, latency = s.ClockOffset, s.Latency
+	threshold := s.Service.Settings.ClockDriftThreshold.Nanoseconds() / 1e6
+	drifting := s.DeviceID != 0 && threshold > 0 && (offset > threshold || offset < -threshold)
+	alert := drifting && !s.clockDrifting
+	s.clockDrifting = drifting
+	s.mutex.Unlock()
+
+	if s.connectionID != 0 {
+		activityWriter().Add(&connectionClock{id: s.connectionID, clockOffset: offset, latency: latency})
+	}
+	if alert {
+		drift := &ClockDrift{
+			Service:     s.Service.Name,
+			Session:     s.SID,
+			Device:      s.DeviceULID,
+			ClockOffset: offset,
+			Latency:     latency,
+			Epoch:       received,
+		}
+		log.Warn("Device clock drift", "device", s.DeviceULID, "offset", offset, "latency", latency)
+		PublishAll(ClockDriftTopic, drift, ClockDriftTopic)
+		s.Notify("time_sync", map[string]interface{}{"epoch": received, "clock_offset": offset})
+	}
+}
+
+// authorizeClockDriftTopic allows the users who can read devices to receive
+// the clock drift alerts
+func authorizeClockDriftTopic(s *Session, topic string) bool {
+	return topic == ClockDriftTopic && s.UID != 0 && canReadModel(s.UID, "Device")
+}
+
+func init() {
+	RegisterTopic(ClockDriftTopic, authorizeClockDriftTopic)
+}
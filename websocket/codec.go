@@ -0,0 +1,251 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/olahol/melody"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	// SubProtocolPrefix is the prefix of the websocket subprotocols that
+	// select the codec of a session, e.g. "jsonrpc.msgpack".
+	SubProtocolPrefix = "jsonrpc"
+	// subProtocolKey is the key of the negotiated subprotocol in the keys
+	// of melody sessions
+	subProtocolKey = "subprotocol"
+	// subProtocolHeader is the header of websocket subprotocols
+	subProtocolHeader = "Sec-WebSocket-Protocol"
+)
+
+// A Codec encodes and decodes the messages exchanged with a client.
+//
+// Messages are always handled as JSON inside the service so that handlers
+// can use json.RawMessage params whatever the wire format is. Codecs of
+// other formats transcode from and to JSON.
+type Codec interface {
+	// Name returns the name of the codec, used as subprotocol suffix
+	Name() string
+	// Binary returns true if messages are sent in binary frames
+	Binary() bool
+	// Marshal returns the encoding of v
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal parses the encoded data and stores the result in v
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// defaultCodec is the codec of the sessions that did not negotiate one
+var defaultCodec Codec = jsonCodec{}
+
+var (
+	codecs = map[string]Codec{
+		"json":    jsonCodec{},
+		"msgpack": msgpackCodec{},
+		"cbor":    cborCodec{},
+	}
+	codecsMutex sync.RWMutex
+)
+
+// RegisterCodec registers a codec that clients can select with the
+// "jsonrpc.<name>" subprotocol. Services offer the codecs registered when
+// they are configured, so codecs should be registered in init functions.
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// lookupCodec returns the registered codec with the given name
+func lookupCodec(name string) (Codec, bool) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+// SubProtocols returns the subprotocols of the registered codecs: the
+// plain JSON-RPC subprotocol followed by the others sorted by name.
+func SubProtocols() []string {
+	codecsMutex.RLock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	codecsMutex.RUnlock()
+	sort.Strings(names)
+	res := []string{SubProtocolPrefix}
+	for _, name := range names {
+		res = append(res, SubProtocolPrefix+"."+name)
+	}
+	return res
+}
+
+// preferredSubProtocols returns the subprotocols offered by the services,
+// in order of preference: the codecs sorted by name, then the plain
+// JSON-RPC subprotocol, so that a client offering a codec gets it.
+func preferredSubProtocols() []string {
+	protocols := SubProtocols()
+	return append(protocols[1:], protocols[0])
+}
+
+// selectCodec returns the first of the offered subprotocols that the client
+// requested in the given headers, and its codec. This is the choice of the
+// websocket upgrader, whose Subprotocols are the offered ones. It returns
+// an empty subprotocol and the default codec if none matches.
+func selectCodec(offered, headers []string) (string, Codec) {
+	requested := make(map[string]bool)
+	for _, header := range headers {
+		for _, proto := range strings.Split(header, ",") {
+			requested[strings.TrimSpace(proto)] = true
+		}
+	}
+	for _, proto := range offered {
+		if !requested[proto] {
+			continue
+		}
+		if codec, ok := subProtocolCodec(proto); ok {
+			return proto, codec
+		}
+	}
+	return "", defaultCodec
+}
+
+// subProtocolCodec returns the codec of the given subprotocol
+func subProtocolCodec(proto string) (Codec, bool) {
+	if proto == SubProtocolPrefix {
+		return defaultCodec, true
+	}
+	if !strings.HasPrefix(proto, SubProtocolPrefix+".") {
+		return nil, false
+	}
+	return lookupCodec(strings.TrimPrefix(proto, SubProtocolPrefix+"."))
+}
+
+// negotiateSubProtocol returns the subprotocol of the websocket connection
+// requested by r, among the given offered subprotocols. The upgrader
+// returns the same subprotocol to the client.
+func negotiateSubProtocol(offered []string, r *http.Request) string {
+	proto, _ := selectCodec(offered, r.Header[http.CanonicalHeaderKey(subProtocolHeader)])
+	return proto
+}
+
+// negotiatedCodec returns the codec of the subprotocol negotiated for the
+// given connection by negotiateSubProtocol
+func negotiatedCodec(s *melody.Session) Codec {
+	value, _ := s.Get(subProtocolKey)
+	proto, _ := value.(string)
+	if codec, ok := subProtocolCodec(proto); ok {
+		return codec
+	}
+	return defaultCodec
+}
+
+// jsonCodec is the default codec sending JSON in text frames
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// msgpackCodec sends MessagePack in binary frames
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	generic, err := jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(generic)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	var generic interface{}
+	if err := msgpack.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	return fromGeneric(generic, v)
+}
+
+// cborCodec sends CBOR in binary frames
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+func (cborCodec) Binary() bool {
+	return true
+}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	generic, err := jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(generic)
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	var generic interface{}
+	if err := cbor.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	return fromGeneric(generic, v)
+}
+
+// fromGeneric stores the given decoded value in v through JSON
+func fromGeneric(generic interface{}, v interface{}) error {
+	data, err := json.Marshal(normalizeMaps(generic))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// normalizeMaps recursively converts the maps with non string keys
+// returned by binary decoders into maps with string keys.
+func normalizeMaps(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			res[fmt.Sprint(k)] = normalizeMaps(item)
+		}
+		return res
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = normalizeMaps(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeMaps(item)
+		}
+	}
+	return value
+}
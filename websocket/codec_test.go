@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/olahol/melody"
+)
+
+func TestSelectCodec(t *testing.T) {
+	tests := []struct {
+		name      string
+		protocols []string
+		proto     string
+		codec     string
+	}{
+		{"none", nil, "", "json"},
+		{"plain", []string{"jsonrpc"}, "jsonrpc", "json"},
+		{"msgpack", []string{"jsonrpc.msgpack"}, "jsonrpc.msgpack", "msgpack"},
+		{"server order", []string{"jsonrpc.msgpack, jsonrpc.cbor"}, "jsonrpc.cbor", "cbor"},
+		{"codec before plain", []string{"jsonrpc, jsonrpc.msgpack"}, "jsonrpc.msgpack", "msgpack"},
+		{"several headers", []string{"chat", "jsonrpc.msgpack"}, "jsonrpc.msgpack", "msgpack"},
+		{"unknown skipped", []string{"jsonrpc.xml,jsonrpc"}, "jsonrpc", "json"},
+		{"other protocols", []string{"chat, mqtt"}, "", "json"},
+		{"prefix only match", []string{"jsonrpcmsgpack"}, "", "json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proto, codec := selectCodec(preferredSubProtocols(), tt.protocols)
+			if proto != tt.proto || codec.Name() != tt.codec {
+				t.Errorf("selectCodec(%q) = %q, %s, want %q, %s", tt.protocols, proto, codec.Name(), tt.proto, tt.codec)
+			}
+		})
+	}
+}
+
+func TestSubProtocols(t *testing.T) {
+	first := SubProtocols()
+	if first[0] != SubProtocolPrefix {
+		t.Errorf("SubProtocols()[0] = %q, want %q", first[0], SubProtocolPrefix)
+	}
+	if !sort.StringsAreSorted(first[1:]) {
+		t.Errorf("SubProtocols() = %q is not sorted", first)
+	}
+	for i := 0; i < 10; i++ {
+		if again := SubProtocols(); !reflect.DeepEqual(again, first) {
+			t.Fatalf("SubProtocols() = %q, then %q", first, again)
+		}
+	}
+	preferred := preferredSubProtocols()
+	if len(preferred) != len(first) || preferred[len(preferred)-1] != SubProtocolPrefix {
+		t.Errorf("preferredSubProtocols() = %q, want the codecs then %q", preferred, SubProtocolPrefix)
+	}
+}
+
+func TestHandleRequestSubProtocol(t *testing.T) {
+	service := &Service{Melody: melody.New(), Name: "test"}
+	service.Configure(nil)
+	negotiated := make(chan string, 1)
+	service.HandleConnect(func(s *melody.Session) {
+		negotiated <- negotiatedCodec(s).Name()
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service.HandleRequest(w, r)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	tests := []struct {
+		protocols []string
+		want      string
+		codec     string
+	}{
+		{nil, "", "json"},
+		{[]string{"chat"}, "", "json"},
+		{[]string{"jsonrpc"}, "jsonrpc", "json"},
+		{[]string{"jsonrpc.msgpack"}, "jsonrpc.msgpack", "msgpack"},
+		{[]string{"jsonrpc", "jsonrpc.cbor"}, "jsonrpc.cbor", "cbor"},
+	}
+	for _, tt := range tests {
+		dialer := websocket.Dialer{Subprotocols: tt.protocols}
+		conn, resp, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Errorf("Dial(%q) error = %v", tt.protocols, err)
+			continue
+		}
+		if got := resp.Header.Get(subProtocolHeader); got != tt.want {
+			t.Errorf("Dial(%q) subprotocol header = %q, want %q", tt.protocols, got, tt.want)
+		}
+		if got := <-negotiated; got != tt.codec {
+			t.Errorf("Dial(%q) session codec = %s, want %s", tt.protocols, got, tt.codec)
+		}
+		conn.Close()
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	request := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      float64(3),
+		"method":  "call_kw",
+		"params":  map[string]interface{}{"args": []interface{}{float64(1), "a", nil}},
+	}
+	for _, name := range []string{"json", "msgpack", "cbor"} {
+		codec, ok := lookupCodec(name)
+		if !ok {
+			t.Fatalf("codec %s is not registered", name)
+		}
+		data, err := codec.Marshal(request)
+		if err != nil {
+			t.Fatalf("%s: Marshal() error = %v", name, err)
+		}
+		var got map[string]interface{}
+		if err := codec.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: Unmarshal() error = %v", name, err)
+		}
+		if !reflect.DeepEqual(got, request) {
+			t.Errorf("%s: round trip = %v, want %v", name, got, request)
+		}
+	}
+}
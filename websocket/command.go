@@ -0,0 +1,298 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/server"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+)
+
+// States of device commands
+const (
+	CommandQueued       = "queued"
+	CommandSent         = "sent"
+	CommandAcknowledged = "acknowledged"
+	CommandFailed       = "failed"
+	CommandExpired      = "expired"
+)
+
+const (
+	// CommandAckTimeout is the time a device has to answer a command
+	// before it is sent again
+	CommandAckTimeout = time.Minute
+	// CommandCheckInterval is the period of the retry and expiry checks
+	CommandCheckInterval = 15 * time.Second
+	// DefaultCommandTTL is the default lifetime of a command
+	DefaultCommandTTL = 24 * time.Hour
+	// DefaultCommandAttempts is the default maximum number of deliveries
+	DefaultCommandAttempts = 3
+)
+
+// CommandParams is the format of the parameters of device_command.
+// TTL is the lifetime of the command in seconds.
+type CommandParams struct {
+	Device  string           `json:"device"`
+	Command string           `json:"command"`
+	Params  *json.RawMessage `json:"params"`
+	TTL     int64            `json:"ttl"`
+}
+
+// deviceSessions returns the sessions of all the services in which the
+// given device is logged in.
+func deviceSessions(deviceID int64) []*Session {
+	var res []*Session
+	Services.Range(func(key, value interface{}) bool {
+		service := value.(*Service)
+		service.Sessions.Range(func(k, v interface{}) bool {
+			if session, ok := v.(*Session); ok && session.DeviceID == deviceID {
+				res = append(res, session)
+			}
+			return true
+		})
+		return true
+	})
+	return res
+}
+
+// publishCommandState notifies the subscribers of the given command
+func publishCommandState(command h.DeviceCommandSet) {
+	PublishAll(RecordChangedMethod, &RecordChange{
+		Model:     "DeviceCommand",
+		Operation: "write",
+		ID:        command.ID(),
+		UID:       security.SuperUserID,
+	}, RecordTopic("DeviceCommand", command.ID()), RecordTopic("DeviceCommand", 0))
+}
+
+// deliverCommand sends the given command to its device if it is online.
+// The command is first claimed, so that it is not sent twice when several
+// deliveries run at the same time. The request ID is derived from the ID of
+// the command and recorded with the claim, so that retries and deliveries
+// after a restart reuse it.
+func deliverCommand(command h.DeviceCommandSet) {
+	sessions := deviceSessions(command.Device().ID())
+	if len(sessions) == 0 {
+		return
+	}
+	var params interface{}
+	if command.Params() != "" {
+		raw := json.RawMessage(command.Params())
+		params = &raw
+	}
+	commandID := command.ID()
+	state, attempts, sentDate := command.State(), command.Attempts(), command.SentDate()
+	// Claiming the command locks its row until the transaction is
+	// committed: commandAnswered waits for this lock if the device answers
+	// very quickly.
+	if !claimCommand(command.Env(), commandID, state, attempts) {
+		return
+	}
+	requestID := commandRequestID(commandID)
+	_, err := sessions[0].CallWithID(requestID, command.Command(), params, func(s *Session, response *ResponseRPC) {
+		commandAnswered(commandID, response)
+	})
+	if err != nil {
+		log.Info("Unable to send device command", "command", commandID, "error", err)
+		command.SetState(state)
+		command.SetAttempts(attempts)
+		command.SetSentDate(sentDate)
+		return
+	}
+	publishCommandState(command)
+}
+
+// commandRequestID returns the ID of the requests delivering the command
+// with the given ID. It is negative so that it never collides with the IDs
+// of the other requests sent to the device, which count up from 1 in each
+// process.
+func commandRequestID(commandID int64) int64 {
+	return -commandID
+}
+
+// claimCommand marks the command with the given ID as sent if it is still
+// in the given state after the given number of attempts, and records its
+// request ID. It returns false if another delivery claimed it first.
+func claimCommand(env models.Environment, id int64, state string, attempts int64) bool {
+	var claimed []int64
+	env.Cr().Select(&claimed, fmt.Sprintf(`UPDATE %s
+		SET state = ?, attempts = COALESCE(attempts, 0) + 1, sent_date = ?, request_id = ?, write_date = now()
+		WHERE id = ? AND state = ? AND COALESCE(attempts, 0) = ?
+		RETURNING id`, h.DeviceCommand().TableName()),
+		CommandSent, time.Now().UTC(), commandRequestID(id), id, state, attempts)
+	return len(claimed) == 1
+}
+
+// commandAnswered records the answer of a device to a command
+func commandAnswered(commandID int64, response *ResponseRPC) {
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		env.Cr().Execute(fmt.Sprintf("SELECT id FROM %s WHERE id = ? FOR UPDATE",
+			h.DeviceCommand().TableName()), commandID)
+		command := h.DeviceCommand().Search(env, q.DeviceCommand().ID().Equals(commandID))
+		if command.IsEmpty() || command.State() != CommandSent {
+			return
+		}
+		data := &h.DeviceCommandData{AckDate: dates.Now()}
+		if response.Error != nil {
+			data.State = CommandFailed
+			data.Error = fmt.Sprintf("%d: %s", response.Error.Code, response.Error.Message)
+		} else {
+			data.State = CommandAcknowledged
+			if response.Result != nil {
+				data.Result = string(*response.Result)
+			}
+		}
+		command.Write(data)
+		publishCommandState(command)
+	})
+}
+
+// flushDeviceCommands sends the queued commands of the given device
+func flushDeviceCommands(deviceID int64) {
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		device := h.Device().Search(env, q.Device().ID().Equals(deviceID))
+		commands := h.DeviceCommand().Search(env,
+			q.DeviceCommand().Device().Equals(device).And().State().Equals(CommandQueued))
+		for _, command := range commands.Records() {
+			deliverCommand(command)
+		}
+	})
+}
+
+// checkCommands expires old commands and sends again the commands that
+// have not been answered in time.
+func checkCommands() {
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		now := dates.Now()
+		expired := h.DeviceCommand().Search(env,
+			q.DeviceCommand().State().In([]string{CommandQueued, CommandSent}).
+				And().ExpireDate().Lower(now))
+		for _, command := range expired.Records() {
+			command.SetState(CommandExpired)
+			publishCommandState(command)
+		}
+		late := h.DeviceCommand().Search(env,
+			q.DeviceCommand().State().Equals(CommandSent).
+				And().SentDate().Lower(dates.DateTime{Time: now.Add(-CommandAckTimeout)}))
+		for _, command := range late.Records() {
+			if command.Attempts() >= command.MaxAttempts() {
+				command.SetState(CommandFailed)
+				command.SetError("No answer from device")
+				publishCommandState(command)
+				continue
+			}
+			deliverCommand(command)
+		}
+	})
+	if err != nil {
+		log.Warn("Device command check failed", "error", err)
+	}
+}
+
+// startCommandChecks starts the periodic retry and expiry of device commands
+func startCommandChecks() {
+	go func() {
+		ticker := time.NewTicker(CommandCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			checkCommands()
+		}
+	}()
+}
+
+// JsonRPCDeviceCommand queues a command for a device and sends it right
+// away if the device is online. It returns the ID of the DeviceCommand
+// record that tracks the command state.
+func JsonRPCDeviceCommand(s *Session, r *RequestRPC) (interface{}, error) {
+	uid := s.UID
+	if uid == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
+	}
+	var params CommandParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return nil, errors.New("JsonRPCDeviceCommand error: Invalid format")
+	}
+	if params.Command == "" {
+		return NewResponseError(r, ErrorCodeInvalidParams, "command is required", nil), nil
+	}
+	ttl := DefaultCommandTTL
+	if params.TTL > 0 {
+		ttl = time.Duration(params.TTL) * time.Second
+	}
+	var commandID int64
+	err = models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		device := h.Device().Search(env, q.Device().Ulid().Equals(params.Device))
+		if device.IsEmpty() {
+			log.Panic("Device not found", "device", params.Device)
+		}
+		data := &h.DeviceCommandData{
+			Device:     device,
+			Command:    params.Command,
+			ExpireDate: dates.DateTime{Time: time.Now().Add(ttl)},
+		}
+		if params.Params != nil {
+			data.Params = string(*params.Params)
+		}
+		commandID = h.DeviceCommand().Create(env, data).ID()
+	})
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		deliverCommand(h.DeviceCommand().Search(env, q.DeviceCommand().ID().Equals(commandID)))
+	})
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  commandID,
+	}, nil
+}
+
+func init() {
+	commandModel := h.DeviceCommand().DeclareModel()
+	commandModel.AddFields(map[string]models.FieldDefinition{
+		"Device": models.Many2OneField{String: "Device", RelationModel: h.Device(),
+			Required: true, Index: true, OnDelete: models.Cascade},
+		"Command": models.CharField{String: "Command", Required: true,
+			Help: "JSON-RPC method called on the device"},
+		"Params": models.TextField{String: "Parameters", Help: "JSON parameters of the command"},
+		"State": models.SelectionField{String: "State", Required: true, Index: true,
+			Selection: types.Selection{
+				CommandQueued:       "Queued",
+				CommandSent:         "Sent",
+				CommandAcknowledged: "Acknowledged",
+				CommandFailed:       "Failed",
+				CommandExpired:      "Expired",
+			},
+			Default: models.DefaultValue(CommandQueued),
+		},
+		"RequestID":   models.IntegerField{String: "Request ID", GoType: new(int64)},
+		"Attempts":    models.IntegerField{String: "Attempts", GoType: new(int64)},
+		"MaxAttempts": models.IntegerField{String: "Max Attempts", GoType: new(int64), Default: models.DefaultValue(int64(DefaultCommandAttempts))},
+		"SentDate":    models.DateTimeField{String: "Sent"},
+		"AckDate":     models.DateTimeField{String: "Answered"},
+		"ExpireDate":  models.DateTimeField{String: "Expires", Index: true},
+		"Result":      models.TextField{String: "Result"},
+		"Error":       models.TextField{String: "Error"},
+	})
+	commandModel.SetDefaultOrder("ID DESC")
+
+	commandModel.AddMethod("ActionSend",
+		`ActionSend sends queued commands to their device if it is online.`,
+		func(rs h.DeviceCommandSet) bool {
+			for _, command := range rs.Records() {
+				if command.State() == CommandQueued {
+					deliverCommand(command)
+				}
+			}
+			return true
+		})
+}
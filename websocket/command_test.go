@@ -0,0 +1,29 @@
+package websocket
+
+import "testing"
+
+func TestCommandRequestID(t *testing.T) {
+	s, _ := newTestSession(nil)
+	var answered []string
+	handler := func(name string) JsonRPCHandleResponseFunc {
+		return func(s *Session, response *ResponseRPC) { answered = append(answered, name) }
+	}
+
+	// The counter of a new process starts again at 1, like the IDs of the
+	// first commands
+	id, _ := s.Call("first", nil, handler("call"))
+	if _, err := s.CallWithID(commandRequestID(id), "reboot", nil, handler("command")); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.pending) != 2 {
+		t.Fatalf("%d requests pending, want 2", len(s.pending))
+	}
+	if commandRequestID(id) >= 0 {
+		t.Errorf("commandRequestID(%d) = %d, want a negative ID", id, commandRequestID(id))
+	}
+	s.popPending(commandRequestID(id))(s, &ResponseRPC{})
+	s.popPending(id)(s, &ResponseRPC{})
+	if len(answered) != 2 || answered[0] != "command" || answered[1] != "call" {
+		t.Errorf("answered handlers = %v, want [command call]", answered)
+	}
+}
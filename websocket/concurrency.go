@@ -0,0 +1,269 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	hc "github.com/hexya-addons/web/controllers"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/server"
+)
+
+const (
+	// ErrorCodeConflict is the error code of writes on records that have
+	// been modified since the client last read them.
+	ErrorCodeConflict ErrorCode = -32009
+	// ExceptionTypeConflict is the exception type of conflict errors
+	ExceptionTypeConflict = "conflict_error"
+	// RecordChangedMethod is the notification method of record changes
+	RecordChangedMethod = "record_changed"
+)
+
+// A ConflictError is raised when a client writes records that have been
+// modified since it last read them.
+type ConflictError struct {
+	Model   string
+	Current map[int64]map[string]interface{}
+}
+
+// Error returns the error message
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Record of %s has been modified by another user", e.Model)
+}
+
+// ExceptionType returns the exception type of conflict errors
+func (e *ConflictError) ExceptionType() string {
+	return ExceptionTypeConflict
+}
+
+// ConflictErrorData is the format of the Data field of conflict errors
+type ConflictErrorData struct {
+	JSONRPCErrorData
+	Model   string                           `json:"model"`
+	Current map[int64]map[string]interface{} `json:"current"`
+}
+
+// RecordChange is the format of the params of record_changed notifications
+type RecordChange struct {
+	Model     string `json:"model"`
+	Operation string `json:"operation"`
+	ID        int64  `json:"id"`
+	WriteDate string `json:"write_date,omitempty"`
+	Version   string `json:"version,omitempty"`
+	UID       int64  `json:"uid"`
+}
+
+// RecordVersion returns the version token of a record given its write date
+func RecordVersion(model string, id int64, writeDate dates.DateTime) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s,%d,%s", model, id, writeDate.String())))
+	return hex.EncodeToString(sum[:8])
+}
+
+// RecordTopic returns the topic of the changes of the given record.
+// If id is 0, it returns the topic of all the records of the model.
+func RecordTopic(model string, id int64) string {
+	if id == 0 {
+		return "record." + model
+	}
+	return fmt.Sprintf("record.%s.%d", model, id)
+}
+
+// parseRecordTopic returns the model and the record id of the given record
+// topic. id is 0 for the topic of all the records of the model.
+func parseRecordTopic(topic string) (string, int64, bool) {
+	parts := strings.Split(topic, ".")
+	if parts[0] != "record" || len(parts) < 2 || len(parts) > 3 || parts[1] == "" {
+		return "", 0, false
+	}
+	if len(parts) == 2 {
+		return parts[1], 0, true
+	}
+	id, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || id <= 0 {
+		return "", 0, false
+	}
+	return parts[1], id, true
+}
+
+// writeCheck holds the expected state of records to write
+type writeCheck struct {
+	field    string
+	expected map[int64]string
+	any      string
+}
+
+// expectation returns the expected value for the record with the given id
+func (wc *writeCheck) expectation(id int64) (string, bool) {
+	if v, ok := wc.expected[id]; ok {
+		return v, true
+	}
+	return wc.any, wc.any != ""
+}
+
+// parseWriteCheck returns the concurrency check given in the kwargs of a
+// write call, or nil if there is none. The write_date or version kwarg is
+// either a single value or an object mapping record ids to values.
+func parseWriteCheck(kwargs map[string]json.RawMessage) *writeCheck {
+	for _, field := range []string{"version", "write_date"} {
+		raw, ok := kwargs[field]
+		if !ok {
+			continue
+		}
+		wc := &writeCheck{field: field, expected: make(map[int64]string)}
+		if err := json.Unmarshal(raw, &wc.any); err == nil {
+			return wc
+		}
+		var values map[string]string
+		if err := json.Unmarshal(raw, &values); err != nil {
+			continue
+		}
+		for k, v := range values {
+			id, err := strconv.ParseInt(k, 10, 64)
+			if err == nil {
+				wc.expected[id] = v
+			}
+		}
+		return wc
+	}
+	return nil
+}
+
+// versionedWrite executes the given write call only if none of the records
+// have been modified since the write date or version given by the client.
+func versionedWrite(s *Session, r *RequestRPC, params hc.CallParams, check *writeCheck) (interface{}, error) {
+	var (
+		res      interface{}
+		conflict *ConflictError
+		ids      []int64
+	)
+	if len(params.Args) > 0 {
+		if err := json.Unmarshal(params.Args[0], &ids); err != nil {
+			var id int64
+			if err = json.Unmarshal(params.Args[0], &id); err == nil {
+				ids = []int64{id}
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return NewResponseError(r, ErrorCodeInvalidParams, "No record to write", nil), nil
+	}
+	var vals map[string]interface{}
+	if len(params.Args) > 1 {
+		json.Unmarshal(params.Args[1], &vals)
+	}
+	err := models.ExecuteInNewEnvironment(s.UID, func(env models.Environment) {
+		rc := env.Pool(params.Model).Call("Browse", ids).(models.RecordSet).Collection()
+		env.Cr().Execute(fmt.Sprintf("SELECT id FROM %s WHERE id IN (?) FOR UPDATE", rc.Model().TableName()), ids)
+		for _, rec := range rc.Records() {
+			expected, ok := check.expectation(rec.ID())
+			if !ok {
+				continue
+			}
+			writeDate := rec.Get("WriteDate").(dates.DateTime)
+			current := writeDate.String()
+			if check.field == "version" {
+				current = RecordVersion(params.Model, rec.ID(), writeDate)
+			}
+			if current == expected {
+				continue
+			}
+			if conflict == nil {
+				conflict = &ConflictError{Model: params.Model, Current: make(map[int64]map[string]interface{})}
+			}
+			values := map[string]interface{}{
+				"write_date": writeDate.String(),
+				"version":    RecordVersion(params.Model, rec.ID(), writeDate),
+			}
+			for field := range vals {
+				value := rec.Get(field)
+				if rs, ok := value.(models.RecordSet); ok {
+					value = rs.Ids()
+				}
+				values[field] = value
+			}
+			conflict.Current[rec.ID()] = values
+		}
+		if conflict != nil {
+			panic(conflict)
+		}
+		res = executeInEnvironment(env, params)
+	})
+	if conflict != nil {
+		data := ConflictErrorData{
+			JSONRPCErrorData: JSONRPCErrorData{
+				Arguments:     conflict.Error(),
+				Message:       conflict.Error(),
+				ExceptionType: conflict.ExceptionType(),
+			},
+			Model:   conflict.Model,
+			Current: conflict.Current,
+		}
+		return NewResponseError(r, ErrorCodeConflict, "Conflict", data), nil
+	}
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	publishRecordChanges(s.UID, params, res)
+	response := &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  res,
+	}
+	return response, nil
+}
+
+// publishRecordChanges notifies the subscribers of the records modified by
+// the given call. res is the result of the call.
+func publishRecordChanges(uid int64, params hc.CallParams, res interface{}) {
+	var ids []int64
+	switch params.Method {
+	case "create":
+		switch v := res.(type) {
+		case int64:
+			ids = []int64{v}
+		case models.RecordSet:
+			ids = v.Ids()
+		}
+	case "write", "unlink":
+		if len(params.Args) == 0 {
+			return
+		}
+		if err := json.Unmarshal(params.Args[0], &ids); err != nil {
+			var id int64
+			if err = json.Unmarshal(params.Args[0], &id); err != nil {
+				return
+			}
+			ids = []int64{id}
+		}
+	default:
+		return
+	}
+	changes := make([]RecordChange, len(ids))
+	for i, id := range ids {
+		changes[i] = RecordChange{Model: params.Model, Operation: params.Method, ID: id, UID: uid}
+	}
+	if params.Method != "unlink" {
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			rc := env.Pool(params.Model).Call("Browse", ids).(models.RecordSet).Collection()
+			dateByID := make(map[int64]dates.DateTime)
+			for _, rec := range rc.Records() {
+				dateByID[rec.ID()] = rec.Get("WriteDate").(dates.DateTime)
+			}
+			for i, change := range changes {
+				if writeDate, ok := dateByID[change.ID]; ok {
+					changes[i].WriteDate = writeDate.String()
+					changes[i].Version = RecordVersion(params.Model, change.ID, writeDate)
+				}
+			}
+		})
+	}
+	for _, change := range changes {
+		PublishAll(RecordChangedMethod, change, RecordTopic(change.Model, change.ID), RecordTopic(change.Model, 0))
+	}
+}
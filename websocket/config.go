@@ -0,0 +1,274 @@
+package websocket
+
+import (
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// readLimitFactor is the ratio of the read limit of the connections to the
+// MaxMessageSize setting
+const readLimitFactor = 2
+
+// ServiceConfig holds the settings of a service
+type ServiceConfig struct {
+	// MaxMessageSize is the maximum size in bytes of a message read from
+	// a client. Larger messages are answered with an error, then the
+	// connection is closed with the "message too big" close code. Messages
+	// of more than twice this size are not read: the connection is closed
+	// without answer.
+	MaxMessageSize int64
+	// MessageBufferSize is the number of messages that can be queued for
+	// sending to a client.
+	MessageBufferSize int
+	// WriteWait is the time allowed to write a message to a client
+	WriteWait time.Duration
+	// PongWait is the time allowed to read the next pong from a client
+	PongWait time.Duration
+	// PingPeriod is the period between websocket pings. It must be less
+	// than PongWait.
+	PingPeriod time.Duration
+	// EnableCompression enables the negotiation of permessage-deflate
+	EnableCompression bool
+	// MaxUploadSize is the maximum size of files uploaded in binary frames
+	MaxUploadSize int64
+	// Debug sends the full text of execution errors to clients
+	Debug bool
+	// LogMessages enables the logging of the messages received from and
+	// sent to clients in JsonServiceLogs
+	LogMessages bool
+	// LogSampleRate is the fraction of the messages that are logged
+	LogSampleRate float64
+	// LogMaxContentSize is the maximum size in bytes of the logged content
+	// of a message. Larger contents are truncated.
+	LogMaxContentSize int
+	// LogRedactFields are fields whose values are not logged, in addition
+	// to DefaultRedactFields
+	LogRedactFields []string
+	// LogRetentionDays is the number of days the message logs are kept.
+	// Logs are kept forever if it is 0.
+	LogRetentionDays int
+	// LogArchiveDir is the directory where purged logs are archived as
+	// gzipped JSON lines. Purged logs are not archived if it is empty.
+	LogArchiveDir string
+	// ClockDriftThreshold is the clock offset of a device above which a
+	// clock_drift notification is published. Drifts are not checked if it
+	// is 0.
+	ClockDriftThreshold time.Duration
+	// HeartbeatInterval is the idle time after which the server sends a
+	// JSON-RPC ping to a client. There is no heartbeat if it is 0, the
+	// default.
+	HeartbeatInterval time.Duration
+	// IdleTimeout is the idle time after which a session is closed. It
+	// should be a few HeartbeatIntervals. Sessions are not closed if it is 0,
+	// the default.
+	IdleTimeout time.Duration
+	// ResumeGracePeriod is the time during which the client of a logged in
+	// session can resume it after a disconnection. Sessions cannot be
+	// resumed if it is 0, the default: clients of services that enable
+	// resumption receive messages numbered with a "seq" member.
+	ResumeGracePeriod time.Duration
+	// OutboxSize is the number of sent messages kept for replay when a
+	// session is resumed
+	OutboxSize int
+	// OutboxMaxBytes is the total size of the sent messages kept for
+	// replay when a session is resumed
+	OutboxMaxBytes int
+	// ReconnectJitter is the period over which the reconnections of the
+	// clients are spread when the service shuts down
+	ReconnectJitter time.Duration
+	// RateLimits are the limits of the requests of each session, user and
+	// remote IP address, by method. The limits of RateLimitAll apply to all
+	// the requests together.
+	RateLimits map[string]MethodLimits
+	// TrustedProxies are the addresses or CIDR networks of the reverse
+	// proxies whose X-Forwarded-For header gives the address of the client
+	// for the IP rate limits
+	TrustedProxies []string
+	// RateLimitMaxViolations is the number of rate limited requests within
+	// RateLimitViolationWindow after which a session is closed. Sessions
+	// are not closed if it is 0.
+	RateLimitMaxViolations   int
+	RateLimitViolationWindow time.Duration
+}
+
+// DefaultServiceConfig returns the default settings of services
+func DefaultServiceConfig() *ServiceConfig {
+	return &ServiceConfig{
+		MaxMessageSize:           1 << 20,
+		MessageBufferSize:        256,
+		WriteWait:                10 * time.Second,
+		PongWait:                 60 * time.Second,
+		PingPeriod:               54 * time.Second,
+		MaxUploadSize:            DefaultMaxUploadSize,
+		LogSampleRate:            1,
+		LogMaxContentSize:        4 << 10,
+		ClockDriftThreshold:      5 * time.Second,
+		OutboxSize:               256,
+		OutboxMaxBytes:           256 << 10,
+		ReconnectJitter:          10 * time.Second,
+		RateLimits:               DefaultRateLimits(),
+		RateLimitMaxViolations:   20,
+		RateLimitViolationWindow: time.Minute,
+	}
+}
+
+// LoadServiceConfig returns the settings of the service with the given name.
+// Settings are read from the "Websocket.<name>" section of the Hexya
+// configuration, e.g. Websocket.jsonrpc.MaxMessageSize, and default to the
+// values of DefaultServiceConfig.
+func LoadServiceConfig(name string) *ServiceConfig {
+	config := DefaultServiceConfig()
+	prefix := "Websocket." + name + "."
+	if viper.IsSet(prefix + "MaxMessageSize") {
+		config.MaxMessageSize = viper.GetInt64(prefix + "MaxMessageSize")
+	}
+	if viper.IsSet(prefix + "MessageBufferSize") {
+		config.MessageBufferSize = viper.GetInt(prefix + "MessageBufferSize")
+	}
+	if viper.IsSet(prefix + "WriteWait") {
+		config.WriteWait = viper.GetDuration(prefix + "WriteWait")
+	}
+	if viper.IsSet(prefix + "PongWait") {
+		config.PongWait = viper.GetDuration(prefix + "PongWait")
+	}
+	if viper.IsSet(prefix + "PingPeriod") {
+		config.PingPeriod = viper.GetDuration(prefix + "PingPeriod")
+	}
+	if viper.IsSet(prefix + "EnableCompression") {
+		config.EnableCompression = viper.GetBool(prefix + "EnableCompression")
+	}
+	if viper.IsSet(prefix + "MaxUploadSize") {
+		config.MaxUploadSize = viper.GetInt64(prefix + "MaxUploadSize")
+	}
+	if viper.IsSet(prefix + "Debug") {
+		config.Debug = viper.GetBool(prefix + "Debug")
+	}
+	if viper.IsSet(prefix + "LogMessages") {
+		config.LogMessages = viper.GetBool(prefix + "LogMessages")
+	}
+	if viper.IsSet(prefix + "LogSampleRate") {
+		config.LogSampleRate = viper.GetFloat64(prefix + "LogSampleRate")
+	}
+	if viper.IsSet(prefix + "LogMaxContentSize") {
+		config.LogMaxContentSize = viper.GetInt(prefix + "LogMaxContentSize")
+	}
+	if viper.IsSet(prefix + "LogRedactFields") {
+		config.LogRedactFields = viper.GetStringSlice(prefix + "LogRedactFields")
+	}
+	if viper.IsSet(prefix + "LogRetentionDays") {
+		config.LogRetentionDays = viper.GetInt(prefix + "LogRetentionDays")
+	}
+	if viper.IsSet(prefix + "LogArchiveDir") {
+		config.LogArchiveDir = viper.GetString(prefix + "LogArchiveDir")
+	}
+	if viper.IsSet(prefix + "ClockDriftThreshold") {
+		config.ClockDriftThreshold = viper.GetDuration(prefix + "ClockDriftThreshold")
+	}
+	if viper.IsSet(prefix + "HeartbeatInterval") {
+		config.HeartbeatInterval = viper.GetDuration(prefix + "HeartbeatInterval")
+	}
+	if viper.IsSet(prefix + "IdleTimeout") {
+		config.IdleTimeout = viper.GetDuration(prefix + "IdleTimeout")
+	}
+	if viper.IsSet(prefix + "ResumeGracePeriod") {
+		config.ResumeGracePeriod = viper.GetDuration(prefix + "ResumeGracePeriod")
+	}
+	if viper.IsSet(prefix + "OutboxSize") {
+		config.OutboxSize = viper.GetInt(prefix + "OutboxSize")
+	}
+	if viper.IsSet(prefix + "OutboxMaxBytes") {
+		config.OutboxMaxBytes = viper.GetInt(prefix + "OutboxMaxBytes")
+	}
+	if viper.IsSet(prefix + "ReconnectJitter") {
+		config.ReconnectJitter = viper.GetDuration(prefix + "ReconnectJitter")
+	}
+	// Configured methods replace the default limits of these methods, e.g.
+	// Websocket.jsonrpc.RateLimits.login.IP.Rate
+	for method := range viper.GetStringMap(prefix + "RateLimits") {
+		key := prefix + "RateLimits." + method + "."
+		config.RateLimits[method] = MethodLimits{
+			Session: RateLimit{Rate: viper.GetFloat64(key + "Session.Rate"), Burst: viper.GetInt(key + "Session.Burst")},
+			User:    RateLimit{Rate: viper.GetFloat64(key + "User.Rate"), Burst: viper.GetInt(key + "User.Burst")},
+			IP:      RateLimit{Rate: viper.GetFloat64(key + "IP.Rate"), Burst: viper.GetInt(key + "IP.Burst")},
+		}
+	}
+	if viper.IsSet(prefix + "TrustedProxies") {
+		config.TrustedProxies = viper.GetStringSlice(prefix + "TrustedProxies")
+	}
+	if viper.IsSet(prefix + "RateLimitMaxViolations") {
+		config.RateLimitMaxViolations = viper.GetInt(prefix + "RateLimitMaxViolations")
+	}
+	if viper.IsSet(prefix + "RateLimitViolationWindow") {
+		config.RateLimitViolationWindow = viper.GetDuration(prefix + "RateLimitViolationWindow")
+	}
+	return config
+}
+
+// Configure applies the given settings to the service. It must be called
+// before the service accepts connections. The service keeps a copy of
+// config with the defaults applied: config itself is not modified.
+func (service *Service) Configure(config *ServiceConfig) {
+	defaults := DefaultServiceConfig()
+	if config == nil {
+		config = defaults
+	}
+	settings := *config
+	config = &settings
+	config.RateLimits = make(map[string]MethodLimits, len(settings.RateLimits))
+	for method, limits := range settings.RateLimits {
+		config.RateLimits[method] = limits
+	}
+	config.LogRedactFields = append([]string(nil), settings.LogRedactFields...)
+	config.TrustedProxies = append([]string(nil), settings.TrustedProxies...)
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = defaults.MaxMessageSize
+	}
+	if config.MessageBufferSize <= 0 {
+		config.MessageBufferSize = defaults.MessageBufferSize
+	}
+	if config.WriteWait <= 0 {
+		config.WriteWait = defaults.WriteWait
+	}
+	if config.PongWait <= 0 {
+		config.PongWait = defaults.PongWait
+	}
+	if config.PingPeriod <= 0 || config.PingPeriod >= config.PongWait {
+		config.PingPeriod = config.PongWait * 9 / 10
+	}
+	if config.MaxUploadSize <= 0 {
+		config.MaxUploadSize = defaults.MaxUploadSize
+	}
+	if config.LogSampleRate > 1 {
+		config.LogSampleRate = 1
+	}
+	if config.IdleTimeout > 0 && config.IdleTimeout <= config.HeartbeatInterval {
+		config.IdleTimeout = 3 * config.HeartbeatInterval
+	}
+	if config.RateLimitViolationWindow <= 0 {
+		config.RateLimitViolationWindow = defaults.RateLimitViolationWindow
+	}
+	if config.LogMaxContentSize <= 0 {
+		config.LogMaxContentSize = defaults.LogMaxContentSize
+	}
+	redactFields := make(map[string]bool)
+	for _, fields := range [][]string{DefaultRedactFields, config.LogRedactFields} {
+		for _, field := range fields {
+			redactFields[strings.ToLower(field)] = true
+		}
+	}
+	service.Settings = config
+	// Messages up to twice the limit are read so that they can be answered
+	service.Config.MaxMessageSize = readLimitFactor * config.MaxMessageSize
+	service.Config.MessageBufferSize = config.MessageBufferSize
+	service.Config.WriteWait = config.WriteWait
+	service.Config.PongWait = config.PongWait
+	service.Config.PingPeriod = config.PingPeriod
+	service.Upgrader.EnableCompression = config.EnableCompression
+	service.Upgrader.Subprotocols = preferredSubProtocols()
+	service.MaxUploadSize = config.MaxUploadSize
+	service.Debug = config.Debug
+	service.redactFields = redactFields
+	service.trustedProxies = parseTrustedProxies(config.TrustedProxies)
+}
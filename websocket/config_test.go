@@ -0,0 +1,55 @@
+package websocket
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/olahol/melody"
+)
+
+func TestConfigureCopiesConfig(t *testing.T) {
+	config := &ServiceConfig{
+		MaxMessageSize:  -1,
+		PongWait:        0,
+		LogSampleRate:   3,
+		LogRedactFields: []string{"Token"},
+		RateLimits:      map[string]MethodLimits{"login": {IP: RateLimit{Rate: 1, Burst: 1}}},
+	}
+	saved := *config
+	savedLimits := map[string]MethodLimits{"login": config.RateLimits["login"]}
+
+	service := &Service{Melody: melody.New()}
+	service.Configure(config)
+
+	if !reflect.DeepEqual(*config, saved) || !reflect.DeepEqual(config.RateLimits, savedLimits) {
+		t.Errorf("Configure() modified its argument: %+v", config)
+	}
+	if service.Settings == config {
+		t.Fatal("Configure() kept the caller's config")
+	}
+	defaults := DefaultServiceConfig()
+	if service.Settings.MaxMessageSize != defaults.MaxMessageSize {
+		t.Errorf("MaxMessageSize = %d, want %d", service.Settings.MaxMessageSize, defaults.MaxMessageSize)
+	}
+	if service.Config.MaxMessageSize != readLimitFactor*defaults.MaxMessageSize {
+		t.Errorf("read limit = %d, want %d", service.Config.MaxMessageSize, readLimitFactor*defaults.MaxMessageSize)
+	}
+	if service.Settings.LogSampleRate != 1 {
+		t.Errorf("LogSampleRate = %v, want 1", service.Settings.LogSampleRate)
+	}
+	if !service.redactFields["token"] {
+		t.Error("LogRedactFields are not redacted")
+	}
+	service.Settings.RateLimits["call_kw"] = MethodLimits{}
+	if _, ok := config.RateLimits["call_kw"]; ok {
+		t.Error("the rate limits of the service are shared with the caller")
+	}
+}
+
+func TestDefaultServiceConfigOptIn(t *testing.T) {
+	defaults := DefaultServiceConfig()
+	if defaults.HeartbeatInterval != 0 || defaults.IdleTimeout != 0 || defaults.ResumeGracePeriod != 0 {
+		t.Errorf("HeartbeatInterval, IdleTimeout and ResumeGracePeriod = %v, %v, %v, want 0",
+			defaults.HeartbeatInterval, defaults.IdleTimeout, defaults.ResumeGracePeriod)
+	}
+}
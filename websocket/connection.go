@@ -0,0 +1,265 @@
+package websocket
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oklog/ulid"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+)
+
+const (
+	// ConnectionActivityInterval is the minimum time between two updates of
+	// the LastActiveEpoch of a connection
+	ConnectionActivityInterval = 5 * time.Second
+	// connectionBatchSize is the maximum number of connections whose
+	// activity is written at once
+	connectionBatchSize = 500
+)
+
+// A connectionActivity is the last activity of a connection
+type connectionActivity struct {
+	id    int64
+	epoch int64
+}
+
+// connectionWriter writes the activity of connections in the background
+var (
+	connectionWriter     *batchWriter
+	connectionWriterOnce sync.Once
+)
+
+// activityWriter returns the writer of the activity of connections
+func activityWriter() *batchWriter {
+	connectionWriterOnce.Do(func() {
+		connectionWriter = newBatchWriter(connectionBatchSize, ConnectionActivityInterval, writeConnectionActivity)
+	})
+	return connectionWriter
+}
+
+// writeConnectionActivity updates the LastActiveEpoch and the clock estimates
+// of connections. An update never moves the epoch of a connection backwards.
+func writeConnectionActivity(items []interface{}) {
+	latest := make(map[int64]int64)
+	clocks := make(map[int64]*connectionClock)
+	for _, item := range items {
+		switch activity := item.(type) {
+		case *connectionActivity:
+			if activity.epoch > latest[activity.id] {
+				latest[activity.id] = activity.epoch
+			}
+		case *connectionClock:
+			clocks[activity.id] = activity
+		}
+	}
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		query := fmt.Sprintf("UPDATE %s SET last_active_epoch = ? WHERE id = ? AND (last_active_epoch IS NULL OR last_active_epoch < ?)",
+			h.JsonServiceConnection().TableName())
+		for id, epoch := range latest {
+			env.Cr().Execute(query, epoch, id, epoch)
+		}
+		query = fmt.Sprintf("UPDATE %s SET clock_offset = ?, latency = ? WHERE id = ?",
+			h.JsonServiceConnection().TableName())
+		for id, clock := range clocks {
+			env.Cr().Execute(query, clock.clockOffset, clock.latency, id)
+		}
+	})
+	if err != nil {
+		log.Warn("Unable to write connection activity", "connections", len(latest), "error", err)
+	}
+}
+
+// peerAddress returns the address and the port of the client of a session
+func peerAddress(s *Session) (string, string) {
+	if s.Request == nil {
+		return "", ""
+	}
+	host, port, err := net.SplitHostPort(s.Request.RemoteAddr)
+	if err != nil {
+		return s.Request.RemoteAddr, ""
+	}
+	return host, port
+}
+
+// connectionULID returns the ULID of the user or the device of a session
+func connectionULID(s *Session) string {
+	if s.ULID != "" {
+		return s.ULID
+	}
+	return s.DeviceULID
+}
+
+// lastActive returns the time of the last activity of the client of the
+// session
+func (s *Session) lastActive() int64 {
+	return atomic.LoadInt64(&s.Epoch)
+}
+
+// touch records the activity of the client of the session
+func (s *Session) touch() {
+	epoch := int64(ulid.Now())
+	atomic.StoreInt64(&s.Epoch, epoch)
+	s.mutex.Lock()
+	due := s.connectionID != 0 && time.Since(s.activityDate) >= ConnectionActivityInterval
+	if due {
+		s.activityDate = time.Now()
+	}
+	s.mutex.Unlock()
+	if due {
+		activityWriter().Add(&connectionActivity{id: s.connectionID, epoch: epoch})
+	}
+}
+
+// openConnection records a new connection of the given session
+func openConnection(s *Session) {
+	epoch := s.lastActive()
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		data := &h.JsonServiceConnectionData{
+			Service:         s.Service.Name,
+			Session:         s.SID,
+			Node:            NodeName,
+			ConnectedEpoch:  epoch,
+			LastActiveEpoch: epoch,
+		}
+		data.PeerAddress, data.PeerPort = peerAddress(s)
+		s.connectionID = h.JsonServiceConnection().Create(env, data).ID()
+	})
+	if err != nil {
+		log.Warn("Unable to record connection", "session", s.SID, "error", err)
+	}
+	s.activityDate = time.Now()
+}
+
+// updateConnectionIdentity records the user or device logged in the session
+// and its SID, which changes when a session is resumed
+func updateConnectionIdentity(s *Session) {
+	if s.connectionID == 0 {
+		return
+	}
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		connection := h.JsonServiceConnection().Search(env, q.JsonServiceConnection().ID().Equals(s.connectionID))
+		connection.Write(&h.JsonServiceConnectionData{
+			Session: s.SID,
+			ULID:    connectionULID(s),
+			User:    h.User().Browse(env, []int64{s.UID}),
+			Device:  h.Device().Browse(env, []int64{s.DeviceID}),
+		}, h.JsonServiceConnection().ULID(), h.JsonServiceConnection().User(), h.JsonServiceConnection().Device())
+	})
+	if err != nil {
+		log.Warn("Unable to record connection identity", "session", s.SID, "error", err)
+	}
+}
+
+// closeConnection marks the connection of the given session offline
+func closeConnection(s *Session) {
+	if s.connectionID == 0 {
+		return
+	}
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		connection := h.JsonServiceConnection().Search(env, q.JsonServiceConnection().ID().Equals(s.connectionID))
+		connection.Write(&h.JsonServiceConnectionData{
+			Offline:         true,
+			LastActiveEpoch: s.lastActive(),
+		}, h.JsonServiceConnection().Offline())
+	})
+	if err != nil {
+		log.Warn("Unable to record disconnection", "session", s.SID, "error", err)
+	}
+}
+
+// ResetAllSession marks offline the connections left online by a previous
+// run of this server instance, e.g. after a crash. It is called at startup,
+// before any client is connected.
+func ResetAllSession() {
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		env.Cr().Execute(fmt.Sprintf("UPDATE %s SET offline = true WHERE offline IS NOT true AND (node = ? OR node IS NULL)",
+			h.JsonServiceConnection().TableName()), NodeName)
+	})
+	if err != nil {
+		log.Warn("Unable to reset connections", "error", err)
+	}
+}
+
+// connectionDuration returns the time between two epochs as a string
+func connectionDuration(start, end int64) string {
+	if start == 0 || end < start {
+		return ""
+	}
+	return (time.Duration(end-start) * time.Millisecond).Round(time.Second).String()
+}
+
+// liveSession returns the session with the given SID of the given service,
+// or nil if it is not connected to this server.
+func liveSession(serviceName, sid string) *Session {
+	service, err := GetService(serviceName)
+	if err != nil {
+		return nil
+	}
+	var res *Session
+	service.Sessions.Range(func(key, value interface{}) bool {
+		if session, ok := value.(*Session); ok && session.SID == sid {
+			res = session
+			return false
+		}
+		return true
+	})
+	return res
+}
+
+// forceRelogin logs out the user of the session and notifies the client
+// that it must log in again.
+func forceRelogin(s *Session) {
+	s.UID = 0
+	s.ULID = ""
+	s.Set("login", nil)
+	s.Set("company_id", nil)
+	s.Unsubscribe(s.Topics()...)
+	updateConnectionIdentity(s)
+	s.Notify("relogin", map[string]interface{}{"epoch": int64(ulid.Now())})
+}
+
+// Back-office actions on the sessions of connections
+const (
+	actionDisconnect = "disconnect"
+	actionPing       = "ping"
+	actionRelogin    = "relogin"
+)
+
+// sessionAction runs the given back-office action on a live session
+func sessionAction(s *Session, action string) {
+	switch action {
+	case actionDisconnect:
+		s.Close()
+	case actionPing:
+		s.Ping()
+	case actionRelogin:
+		forceRelogin(s)
+	}
+}
+
+// connectionAction runs the given back-office action on the session of the
+// given connection, on whatever server instance it is connected. It
+// returns false if the session is not connected to a running server.
+func connectionAction(connection h.JsonServiceConnectionSet, action string) bool {
+	if session := liveSession(connection.Service(), connection.Session()); session != nil {
+		sessionAction(session, action)
+		return true
+	}
+	if node := connection.Node(); node == "" || node == NodeName {
+		return false
+	}
+	broadcast(&StoreMessage{
+		Kind:    StoreAction,
+		Service: connection.Service(),
+		SID:     connection.Session(),
+		Method:  action,
+	})
+	return true
+}
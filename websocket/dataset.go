@@ -20,14 +20,23 @@ import (
 func JsonRPCCallKW(s *Session, r *RequestRPC) (interface{}, error) {
 	uid := s.UID
 	if uid == 0 {
-		return nil, errors.New("Access denied")
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
 	}
 	var params hc.CallParams
 	err := json.Unmarshal(*r.Params, &params)
 	if err != nil {
 		return nil, errors.New("JsonRPCCallKW error: Invalid format")
 	}
-	res, err := hc.Execute(uid, params)
+	if params.Method == "write" {
+		if check := parseWriteCheck(params.KWArgs); check != nil {
+			return versionedWrite(s, r, params, check)
+		}
+	}
+	res, err := executeCall(uid, params)
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	publishRecordChanges(uid, params, res)
 	response := &server.ResponseRPC{
 		JsonRPC: r.JsonRPC,
 		ID:      r.ID,
@@ -40,7 +49,7 @@ func JsonRPCCallKW(s *Session, r *RequestRPC) (interface{}, error) {
 func JsonRPCCallButton(s *Session, r *RequestRPC) (interface{}, error) {
 	uid := s.UID
 	if uid == 0 {
-		return nil, errors.New("Access denied")
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
 	}
 	var params hc.CallParams
 	err := json.Unmarshal(*r.Params, &params)
@@ -48,7 +57,10 @@ func JsonRPCCallButton(s *Session, r *RequestRPC) (interface{}, error) {
 		return nil, errors.New("JsonRPCCallButton error: Invalid format")
 	}
 
-	res, err := hc.Execute(uid, params)
+	res, err := executeCall(uid, params)
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
 	_, isAction := res.(actions.Action)
 	_, isActionPtr := res.(*actions.Action)
 	if !isAction && !isActionPtr {
@@ -67,7 +79,7 @@ func JsonRPCCallButton(s *Session, r *RequestRPC) (interface{}, error) {
 func JsonRPCSearchRead(s *Session, r *RequestRPC) (interface{}, error) {
 	uid := s.UID
 	if uid == 0 {
-		return nil, errors.New("Access denied")
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
 	}
 	var params hc.SearchReadParams
 	err := json.Unmarshal(*r.Params, &params)
@@ -76,6 +88,9 @@ func JsonRPCSearchRead(s *Session, r *RequestRPC) (interface{}, error) {
 	}
 
 	res, err := hc.SearchRead(uid, params)
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
 
 	response := &server.ResponseRPC{
 		JsonRPC: r.JsonRPC,
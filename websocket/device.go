@@ -0,0 +1,283 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/oklog/ulid"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/server"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+)
+
+const (
+	// DeviceAuthJWT authenticates devices with a device token
+	DeviceAuthJWT = "jwt"
+	// DeviceAuthPSK authenticates devices with a pre-shared key
+	DeviceAuthPSK = "psk"
+	// deviceTokenType is the "typ" claim of device tokens
+	deviceTokenType = "device"
+)
+
+// DeviceLogin is the format of the parameters of device_login. Token is
+// used by devices authenticating with a JWT and Key by devices using a
+// pre-shared key.
+type DeviceLogin struct {
+	Ulid  string `json:"ulid"`
+	Token string `json:"token,omitempty"`
+	Key   string `json:"key,omitempty"`
+}
+
+// DeviceLoginResponse is the result of device_login
+type DeviceLoginResponse struct {
+	ID       int64  `json:"id"`
+	Ulid     string `json:"ulid"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Firmware string `json:"firmware"`
+	Epoch    int64  `json:"epoch"`
+	// SID is the ID of the session and ResumeToken the secret needed to
+	// resume it after a reconnection, if session resumption is enabled
+	SID         string `json:"sid"`
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+// hashDeviceKey returns the hash stored for the given pre-shared key
+func hashDeviceKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newDeviceKey returns a new random pre-shared key
+func newDeviceKey() string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Panic("Unable to generate device key", "error", err)
+	}
+	return hex.EncodeToString(key)
+}
+
+// authenticateDevice returns the ID of the device with the given
+// credentials or 0 if the credentials are invalid.
+func authenticateDevice(env models.Environment, login *DeviceLogin) int64 {
+	if login.Ulid == "" {
+		return 0
+	}
+	device := h.Device().Search(env, q.Device().Ulid().Equals(login.Ulid).And().Active().Equals(true))
+	if device.IsEmpty() {
+		return 0
+	}
+	switch device.AuthMethod() {
+	case DeviceAuthPSK:
+		if login.Key == "" || device.KeyHash() == "" {
+			return 0
+		}
+		if subtle.ConstantTimeCompare([]byte(hashDeviceKey(login.Key)), []byte(device.KeyHash())) != 1 {
+			return 0
+		}
+	default:
+		claims, err := idp.IdentityMap(login.Token)
+		if err != nil {
+			return 0
+		}
+		if claims["sub"] != device.Ulid() || claims["typ"] != deviceTokenType {
+			return 0
+		}
+		if ver, ok := claims["ver"].(float64); !ok || int64(ver) != device.TokenVersion() {
+			return 0
+		}
+	}
+	return device.ID()
+}
+
+// setDeviceOnline updates the online state and last seen time of a device
+func setDeviceOnline(deviceID int64, online bool) {
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		device := h.Device().Search(env, q.Device().ID().Equals(deviceID))
+		if device.IsEmpty() {
+			return
+		}
+		device.Write(&h.DeviceData{
+			Online:   online,
+			LastSeen: dates.Now(),
+		}, h.Device().Online())
+	})
+}
+
+// deviceDisconnected marks the device of the session offline, unless it
+// has another session.
+func deviceDisconnected(s *Session) {
+	if s.DeviceID == 0 || len(deviceSessions(s.DeviceID)) > 0 {
+		return
+	}
+	setDeviceOnline(s.DeviceID, false)
+}
+
+// JsonRPCDeviceLogin authenticates a device and attaches its identity to
+// the session. A device session has no user: its UID is not set.
+func JsonRPCDeviceLogin(s *Session, r *RequestRPC) (interface{}, error) {
+	var login DeviceLogin
+	err := json.Unmarshal(*r.Params, &login)
+	if err != nil {
+		return nil, errors.New("Device login error: Invalid format")
+	}
+	var res *DeviceLoginResponse
+	err = models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		deviceID := authenticateDevice(env, &login)
+		if deviceID == 0 {
+			return
+		}
+		device := h.Device().Search(env, q.Device().ID().Equals(deviceID))
+		res = &DeviceLoginResponse{
+			ID:       device.ID(),
+			Ulid:     device.Ulid(),
+			Name:     device.Name(),
+			Type:     device.DeviceType(),
+			Firmware: device.Firmware(),
+			Epoch:    int64(ulid.Now()),
+		}
+	})
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	if res == nil {
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrInvalidCredentials.Error(), nil), nil
+	}
+	s.DeviceID = res.ID
+	s.DeviceULID = res.Ulid
+	s.DeviceType = res.Type
+	s.Set("device", res.Ulid)
+	updateConnectionIdentity(s)
+	deviceConnected(res.ID)
+	res.SID = s.SID
+	res.ResumeToken = s.issueResumeToken()
+
+	response := &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  res,
+	}
+	return response, nil
+}
+
+// deviceConnected marks the given device online and sends it the commands,
+// shadow delta and firmware waiting for it
+func deviceConnected(deviceID int64) {
+	setDeviceOnline(deviceID, true)
+	go flushDeviceCommands(deviceID)
+	go deviceShadowConnected(deviceID)
+	go offerDeviceFirmware(deviceID)
+}
+
+// JsonRPCDeviceToken returns a new token for the given device. It is called
+// by users to provision devices that authenticate with a JWT, or with
+// {"psk": true} to generate a new pre-shared key.
+func JsonRPCDeviceToken(s *Session, r *RequestRPC) (interface{}, error) {
+	uid := s.UID
+	if uid == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
+	}
+	params := struct {
+		Ulid string `json:"ulid"`
+		PSK  bool   `json:"psk"`
+	}{}
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return nil, errors.New("JsonRPCDeviceToken error: Invalid format")
+	}
+	data := gin.H{
+		"epoch": int64(ulid.Now()),
+		"ulid":  params.Ulid,
+	}
+	err = models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		device := h.Device().Search(env, q.Device().Ulid().Equals(params.Ulid))
+		if device.IsEmpty() {
+			log.Panic("Device not found", "ulid", params.Ulid)
+		}
+		if params.PSK {
+			data["key"] = device.GenerateKey()
+			return
+		}
+		data["token"] = device.GenerateToken()
+	})
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	response := &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  &data,
+	}
+	return response, nil
+}
+
+func init() {
+	deviceModel := h.Device().DeclareModel()
+	deviceModel.AddFields(map[string]models.FieldDefinition{
+		"Ulid": models.CharField{JSON: `ulid`, Required: true, Index: true, Unique: true, NoCopy: true,
+			Default: func(env models.Environment) interface{} { return NewULID() },
+		},
+		"Name":       models.CharField{String: "Name", Required: true},
+		"Owner":      models.Many2OneField{String: "Owner", RelationModel: h.Partner()},
+		"Company":    models.Many2OneField{String: "Company", RelationModel: h.Company()},
+		"DeviceType": models.CharField{String: "Type", Index: true},
+		"Firmware":   models.CharField{String: "Firmware Version"},
+		"LastSeen":   models.DateTimeField{String: "Last Seen"},
+		"Online":     models.BooleanField{String: "Online", Index: true},
+		"Active": models.BooleanField{String: "Active",
+			Default: models.DefaultValue(true),
+		},
+		"AuthMethod": models.SelectionField{String: "Authentication", Required: true,
+			Selection: types.Selection{DeviceAuthJWT: "Device Token", DeviceAuthPSK: "Pre-Shared Key"},
+			Default:   models.DefaultValue(DeviceAuthJWT),
+		},
+		"KeyHash": models.CharField{String: "Key Hash", NoCopy: true,
+			Help: "SHA-256 hash of the pre-shared key of the device"},
+		"TokenVersion": models.IntegerField{String: "Token Version", GoType: new(int64), NoCopy: true,
+			Help: "Incremented each time a token is generated to revoke previous tokens"},
+	})
+	deviceModel.SetDefaultOrder("Name")
+
+	deviceModel.AddMethod("GenerateToken",
+		`GenerateToken returns a new device token for this device and revokes
+		the previous ones.`,
+		func(rs h.DeviceSet) string {
+			rs.EnsureOne()
+			version := rs.TokenVersion() + 1
+			rs.SetTokenVersion(version)
+			token, err := idp.SignedClaims(jwt.MapClaims{
+				"aud": "hexya",
+				"iss": issuer,
+				"sub": rs.Ulid(),
+				"typ": deviceTokenType,
+				"ver": version,
+				"iat": time.Now().UTC().Unix(),
+			})
+			if err != nil {
+				log.Panic("Unable to sign device token", "device", rs.Ulid(), "error", err)
+			}
+			return token
+		})
+
+	deviceModel.AddMethod("GenerateKey",
+		`GenerateKey returns a new pre-shared key for this device. Only its hash
+		is stored, so the key must be saved by the caller.`,
+		func(rs h.DeviceSet) string {
+			rs.EnsureOne()
+			key := newDeviceKey()
+			rs.SetKeyHash(hashDeviceKey(key))
+			return key
+		})
+}
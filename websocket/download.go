@@ -0,0 +1,412 @@
+package websocket
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/server"
+)
+
+const (
+	// DownloadChunkSize is the size of the binary frames of downloads
+	DownloadChunkSize = 32 << 10
+	// DownloadWindow is the number of frames that may be sent before
+	// the client acknowledges them. It must stay well below the send buffer
+	// size of the service.
+	DownloadWindow = 8
+	// DownloadExpiry is the duration after which an idle download is discarded
+	DownloadExpiry = time.Hour
+	// downloadExpiryInterval is the period of the checks of idle downloads
+	downloadExpiryInterval = time.Minute
+	// MaxPendingDownloads is the number of downloads that the user or the
+	// device of a session may have pending at the same time
+	MaxPendingDownloads = 4
+	// MaxPendingDownloadBytes is the total size of the downloads that the
+	// user or the device of a session may have pending at the same time
+	MaxPendingDownloadBytes = 64 << 20
+)
+
+// ErrTooManyDownloads is returned when a session requests a download while
+// its pending downloads already reach MaxPendingDownloads or
+// MaxPendingDownloadBytes
+var ErrTooManyDownloads = errors.New("Too many pending downloads")
+
+// DownloadParams is the format of the parameters of download and
+// download_report
+type DownloadParams struct {
+	Model  string  `json:"model"`
+	ID     int64   `json:"id"`
+	Field  string  `json:"field"`
+	Name   string  `json:"name"`
+	Report string  `json:"report"`
+	IDs    []int64 `json:"ids"`
+}
+
+// DownloadAckParams is the format of the parameters of download_ack and
+// download_cancel
+type DownloadAckParams struct {
+	DownloadID string `json:"download_id"`
+	Offset     int64  `json:"offset"`
+}
+
+// DownloadProgress is the result of download_ack. Sent is the offset up to
+// which frames have been sent and Done is true once all of them have.
+type DownloadProgress struct {
+	DownloadID string `json:"download_id"`
+	Acked      int64  `json:"acked"`
+	Sent       int64  `json:"sent"`
+	Size       int64  `json:"size"`
+	Done       bool   `json:"done"`
+}
+
+// DownloadStatus is the result of download and download_report and the
+// params of the download_done notification
+type DownloadStatus struct {
+	DownloadID string `json:"download_id"`
+	Name       string `json:"name"`
+	MimeType   string `json:"mimetype"`
+	Size       int64  `json:"size"`
+	ChunkSize  int    `json:"chunk_size,omitempty"`
+	Window     int    `json:"window,omitempty"`
+	Checksum   string `json:"checksum,omitempty"`
+}
+
+// A ReportRenderer renders a report of the records with the given ids and
+// returns its content, its file name and its MIME type.
+type ReportRenderer func(env models.Environment, ids []int64) (content []byte, name string, mimeType string)
+
+var reportRenderers sync.Map
+
+// RegisterReport registers the renderer of the report with the given name
+// so that it can be downloaded with download_report.
+func RegisterReport(name string, renderer ReportRenderer) error {
+	if name == "" || renderer == nil {
+		return errors.New("RegisterReport: report name and renderer should not be empty")
+	}
+	if _, exists := reportRenderers.LoadOrStore(name, renderer); exists {
+		return errors.New("RegisterReport: Report is registered")
+	}
+	return nil
+}
+
+// A download is a content being sent to a client in binary frames
+type download struct {
+	sync.Mutex
+	DownloadStatus
+	uid      int64
+	deviceID int64
+	session  *Session
+	content  []byte
+	sent     int64
+	acked    int64
+	done     bool
+	updated  time.Time
+}
+
+var (
+	downloads sync.Map
+	// downloadsMutex serializes the creation of downloads so that the
+	// limits of pending downloads hold
+	downloadsMutex sync.Mutex
+)
+
+// getDownload returns the download with the given id or nil
+func getDownload(id string) *download {
+	if dl, ok := downloads.Load(id); ok {
+		return dl.(*download)
+	}
+	return nil
+}
+
+// expireDownloads discards downloads that have been idle for DownloadExpiry
+func expireDownloads() {
+	downloads.Range(func(key, value interface{}) bool {
+		dl := value.(*download)
+		dl.Lock()
+		expired := time.Since(dl.updated) > DownloadExpiry
+		dl.Unlock()
+		if expired {
+			downloads.Delete(key)
+		}
+		return true
+	})
+}
+
+// startDownloadExpiry starts the periodic checks of idle downloads
+func startDownloadExpiry() {
+	go func() {
+		ticker := time.NewTicker(downloadExpiryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			expireDownloads()
+		}
+	}()
+}
+
+// newDownload registers a new download of content for the given session.
+// It returns ErrTooManyDownloads if the download would exceed the limits of
+// the pending downloads of the user or device of the session. Downloads
+// are pending until their last acknowledgement or their expiry.
+func newDownload(s *Session, content []byte, name, mimeType string) (*download, error) {
+	if mimeType == "" {
+		mimeType = http.DetectContentType(content)
+	}
+	sum := sha256.Sum256(content)
+	dl := &download{
+		DownloadStatus: DownloadStatus{
+			DownloadID: NewULID(),
+			Name:       name,
+			MimeType:   mimeType,
+			Size:       int64(len(content)),
+			ChunkSize:  DownloadChunkSize,
+			Window:     DownloadWindow,
+			Checksum:   hex.EncodeToString(sum[:]),
+		},
+		uid:      s.UID,
+		deviceID: s.DeviceID,
+		session:  s,
+		content:  content,
+		updated:  time.Now(),
+	}
+	downloadsMutex.Lock()
+	defer downloadsMutex.Unlock()
+	count, size := pendingDownloads(s)
+	if count >= MaxPendingDownloads || size+dl.Size > MaxPendingDownloadBytes {
+		return nil, ErrTooManyDownloads
+	}
+	downloads.Store(dl.DownloadID, dl)
+	return dl, nil
+}
+
+// pendingDownloads returns the number and the total size of the pending
+// downloads of the user or device of the given session
+func pendingDownloads(s *Session) (int, int64) {
+	var (
+		count int
+		size  int64
+	)
+	downloads.Range(func(key, value interface{}) bool {
+		if dl := value.(*download); dl.ownedBy(s) {
+			count++
+			size += dl.Size
+		}
+		return true
+	})
+	return count, size
+}
+
+// ownedBy returns true if the download was requested by the user or the
+// device of the given session.
+func (dl *download) ownedBy(s *Session) bool {
+	return dl.uid == s.UID && dl.deviceID == s.DeviceID
+}
+
+// ack acknowledges all the data before offset and sends the next frames
+// allowed by the window. Acknowledging again an offset that was already
+// acknowledged makes the download restart from there, e.g. after a
+// reconnection. A client that kept the beginning of the content from a
+// previous download can also start a new one at a higher offset. offset
+// must be between 0 and the size of the download.
+func (dl *download) ack(s *Session, offset int64) *DownloadProgress {
+	dl.Lock()
+	defer dl.Unlock()
+	dl.session = s
+	dl.updated = time.Now()
+	if offset <= dl.acked && offset < dl.sent {
+		dl.sent = offset
+		dl.done = false
+	}
+	dl.acked = offset
+	if dl.sent < offset {
+		dl.sent = offset
+	}
+	limit := offset + int64(DownloadChunkSize*DownloadWindow)
+	for dl.sent < dl.Size && dl.sent < limit {
+		end := dl.sent + DownloadChunkSize
+		if end > dl.Size {
+			end = dl.Size
+		}
+		frame := encodeTransferFrame(dl.DownloadID, dl.sent, dl.content[dl.sent:end])
+		if err := s.WriteBinary(frame); err != nil {
+			log.Info("Unable to send download frame", "download", dl.DownloadID, "error", err)
+			return dl.progress()
+		}
+		dl.sent = end
+	}
+	if dl.sent == dl.Size && !dl.done {
+		dl.done = true
+		st := dl.DownloadStatus
+		st.ChunkSize = 0
+		st.Window = 0
+		s.Notify("download_done", &st)
+	}
+	if offset == dl.Size {
+		downloads.Delete(dl.DownloadID)
+	}
+	return dl.progress()
+}
+
+// progress returns the progress of the download. dl must be locked.
+func (dl *download) progress() *DownloadProgress {
+	return &DownloadProgress{
+		DownloadID: dl.DownloadID,
+		Acked:      dl.acked,
+		Sent:       dl.sent,
+		Size:       dl.Size,
+		Done:       dl.done,
+	}
+}
+
+// fieldContent returns the decoded content of a binary field
+func fieldContent(value interface{}) []byte {
+	switch v := value.(type) {
+	case []byte:
+		return v
+	case string:
+		if data, err := base64.StdEncoding.DecodeString(v); err == nil {
+			return data
+		}
+		return []byte(v)
+	}
+	return []byte(fmt.Sprint(value))
+}
+
+// JsonRPCDownload prepares the download of the content of a field of a
+// record. The client then calls download_ack with offset 0 to start
+// receiving binary frames made of the download ID, the big endian offset
+// of the chunk on 8 bytes and the chunk data. A download_done notification
+// carrying the checksum is sent after the last frame.
+func JsonRPCDownload(s *Session, r *RequestRPC) (interface{}, error) {
+	uid := s.UID
+	if uid == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
+	}
+	var params DownloadParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return nil, errors.New("JsonRPCDownload error: Invalid format")
+	}
+	if params.Model == "" || params.ID == 0 || params.Field == "" {
+		return NewResponseError(r, ErrorCodeInvalidParams, "model, id and field are required", nil), nil
+	}
+	var content []byte
+	name := params.Name
+	err = models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		checkRecordAccess(env, params.Model, params.ID)
+		rc := env.Pool(params.Model).Call("Browse", []int64{params.ID}).(models.RecordSet).Collection()
+		content = fieldContent(rc.Get(params.Field))
+		if name == "" {
+			name = fmt.Sprintf("%s-%d-%s", params.Model, params.ID, params.Field)
+		}
+	})
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	dl, err := newDownload(s, content, name, "")
+	if err != nil {
+		return NewResponseError(r, ErrorCodeRateLimited, err.Error(), nil), nil
+	}
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  &dl.DownloadStatus,
+	}, nil
+}
+
+// JsonRPCDownloadReport renders the given report and prepares its download.
+// The content is then streamed as with download.
+func JsonRPCDownloadReport(s *Session, r *RequestRPC) (interface{}, error) {
+	uid := s.UID
+	if uid == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
+	}
+	var params DownloadParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return nil, errors.New("JsonRPCDownloadReport error: Invalid format")
+	}
+	renderer, ok := reportRenderers.Load(params.Report)
+	if !ok {
+		return NewResponseError(r, ErrorCodeNotFound, "Report not found: "+params.Report, nil), nil
+	}
+	ids := params.IDs
+	if len(ids) == 0 && params.ID != 0 {
+		ids = []int64{params.ID}
+	}
+	var (
+		content        []byte
+		name, mimeType string
+	)
+	err = models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		content, name, mimeType = renderer.(ReportRenderer)(env, ids)
+	})
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	if params.Name != "" {
+		name = params.Name
+	}
+	dl, err := newDownload(s, content, name, mimeType)
+	if err != nil {
+		return NewResponseError(r, ErrorCodeRateLimited, err.Error(), nil), nil
+	}
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  &dl.DownloadStatus,
+	}, nil
+}
+
+// JsonRPCDownloadAck acknowledges the data received by the client up to the
+// given offset and lets the server send the next frames. It returns the
+// progress of the download once the frames are sent.
+func JsonRPCDownloadAck(s *Session, r *RequestRPC) (interface{}, error) {
+	if r.Params == nil {
+		return NewResponseError(r, ErrorCodeInvalidParams, "JsonRPCDownloadAck error: Missing parameters", nil), nil
+	}
+	var params DownloadAckParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return nil, errors.New("JsonRPCDownloadAck error: Invalid format")
+	}
+	dl := getDownload(params.DownloadID)
+	if dl == nil || !dl.ownedBy(s) {
+		return NewResponseError(r, ErrorCodeNotFound, "Download not found: "+params.DownloadID, nil), nil
+	}
+	if params.Offset < 0 || params.Offset > dl.Size {
+		msg := fmt.Sprintf("Invalid offset %d: download size is %d", params.Offset, dl.Size)
+		return NewResponseError(r, ErrorCodeInvalidParams, msg, nil), nil
+	}
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  dl.ack(s, params.Offset),
+	}, nil
+}
+
+// JsonRPCDownloadCancel discards a download
+func JsonRPCDownloadCancel(s *Session, r *RequestRPC) (interface{}, error) {
+	var params DownloadAckParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return nil, errors.New("JsonRPCDownloadCancel error: Invalid format")
+	}
+	dl := getDownload(params.DownloadID)
+	if dl == nil || !dl.ownedBy(s) {
+		return NewResponseError(r, ErrorCodeNotFound, "Download not found: "+params.DownloadID, nil), nil
+	}
+	downloads.Delete(params.DownloadID)
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  true,
+	}, nil
+}
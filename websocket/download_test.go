@@ -0,0 +1,99 @@
+package websocket
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDownloadAck(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), DownloadChunkSize*DownloadWindow/8)
+	s, transport := newTestSession(nil)
+	dl, err := newDownload(s, content, "test.bin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downloads.Delete(dl.DownloadID)
+	size := int64(len(content))
+	window := int64(DownloadChunkSize * DownloadWindow)
+
+	tests := []struct {
+		name   string
+		offset int64
+		sent   int64
+		frames int
+		done   bool
+	}{
+		{"start", 0, window, DownloadWindow, false},
+		{"same offset restarts", 0, window, DownloadWindow, false},
+		{"next window", window, size, DownloadWindow, true},
+		{"resume", window / 2, window/2 + window, DownloadWindow, false},
+	}
+	for _, tt := range tests {
+		transport.binary = nil
+		progress := dl.ack(s, tt.offset)
+		if progress.Acked != tt.offset || progress.Sent != tt.sent || progress.Done != tt.done || progress.Size != size {
+			t.Errorf("%s: ack(%d) = %+v", tt.name, tt.offset, progress)
+		}
+		if len(transport.binary) != tt.frames {
+			t.Errorf("%s: %d frames sent, want %d", tt.name, len(transport.binary), tt.frames)
+		}
+		for _, frame := range transport.binary {
+			id, offset, data, ok := decodeTransferFrame(frame)
+			if !ok || id != dl.DownloadID || !bytes.Equal(data, content[offset:offset+int64(len(data))]) {
+				t.Errorf("%s: invalid frame at offset %d", tt.name, offset)
+			}
+		}
+	}
+	dl.ack(s, size)
+	if getDownload(dl.DownloadID) != nil {
+		t.Error("download not removed after the last acknowledgement")
+	}
+}
+
+func TestNewDownloadLimits(t *testing.T) {
+	s, _ := newTestSession(nil)
+	s.UID = 42
+	other, _ := newTestSession(nil)
+	other.UID = 43
+	var created []*download
+	defer func() {
+		for _, dl := range created {
+			downloads.Delete(dl.DownloadID)
+		}
+	}()
+
+	for i := 0; i < MaxPendingDownloads; i++ {
+		dl, err := newDownload(s, []byte("content"), "test.txt", "")
+		if err != nil {
+			t.Fatalf("download %d: newDownload() error = %v", i, err)
+		}
+		created = append(created, dl)
+	}
+	if _, err := newDownload(s, []byte("content"), "test.txt", ""); err != ErrTooManyDownloads {
+		t.Errorf("newDownload() over the count limit error = %v, want %v", err, ErrTooManyDownloads)
+	}
+	// A new session of the same user shares its limits
+	again, _ := newTestSession(nil)
+	again.UID = s.UID
+	if _, err := newDownload(again, []byte("content"), "test.txt", ""); err != ErrTooManyDownloads {
+		t.Errorf("newDownload() from another session of the user error = %v, want %v", err, ErrTooManyDownloads)
+	}
+	created[0].ack(s, created[0].Size)
+	if dl, err := newDownload(s, []byte("content"), "test.txt", ""); err != nil {
+		t.Errorf("newDownload() after a completed download error = %v", err)
+	} else {
+		created = append(created, dl)
+	}
+
+	if _, err := newDownload(other, make([]byte, MaxPendingDownloadBytes+1), "big.bin", ""); err != ErrTooManyDownloads {
+		t.Errorf("newDownload() over the size limit error = %v, want %v", err, ErrTooManyDownloads)
+	}
+	dl, err := newDownload(other, make([]byte, MaxPendingDownloadBytes), "big.bin", "")
+	if err != nil {
+		t.Fatalf("newDownload() at the size limit error = %v", err)
+	}
+	created = append(created, dl)
+	if _, err := newDownload(other, []byte("x"), "small.txt", ""); err != ErrTooManyDownloads {
+		t.Errorf("newDownload() over the remaining size error = %v, want %v", err, ErrTooManyDownloads)
+	}
+}
@@ -0,0 +1,171 @@
+package websocket
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/oklog/ulid"
+)
+
+// Exception types reported in the data of execution errors
+const (
+	ExceptionTypeAccess     = "access_error"
+	ExceptionTypeValidation = "validation_error"
+	ExceptionTypeUser       = "user_error"
+	ExceptionTypeInternal   = "internal_error"
+)
+
+// Errors that handlers can return, possibly wrapped, to report an access or
+// validation error to the client
+var (
+	ErrAccessDenied = errors.New("Access denied")
+	ErrValidation   = errors.New("Invalid data")
+)
+
+// hexyaAccessPrefix is the beginning of the message of the errors raised by
+// Hexya when a user is not allowed to execute a method. Hexya does not
+// give these errors a type.
+const hexyaAccessPrefix = "You are not allowed to"
+
+// validationMarkers are found in the first line of the validation errors
+// raised by Hexya and PostgreSQL. Errors raised in a Hexya environment are
+// recovered into plain errors holding their text, so their type is lost.
+var validationMarkers = []string{
+	"ValidationError",
+	"violates unique constraint",
+	"violates foreign key constraint",
+	"violates not-null constraint",
+	"violates check constraint",
+	"violates exclusion constraint",
+}
+
+// An ExceptionTyper is an error that knows its exception type.
+type ExceptionTyper interface {
+	error
+	ExceptionType() string
+}
+
+// A UserError is an error whose message is meant for the user
+type UserError struct {
+	Message string
+}
+
+// Error returns the message of the error
+func (e *UserError) Error() string {
+	return e.Message
+}
+
+// ExceptionType returns the exception type of user errors
+func (e *UserError) ExceptionType() string {
+	return ExceptionTypeUser
+}
+
+// NewResponseError returns a ResponseError answering the given request
+func NewResponseError(r *RequestRPC, code ErrorCode, message string, data interface{}) *ResponseError {
+	return &ResponseError{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Error: JSONRPCError{
+			Epoch:   int64(ulid.Now()),
+			Code:    int(code),
+			Message: message,
+			Data:    data,
+		},
+	}
+}
+
+// NewExecutionError returns a ResponseError describing an error raised
+// while executing a method on the server. The client only gets a message
+// that depends on the exception type, unless the error is a user error.
+// The full error text is only sent in the debug field if the service of the
+// session is in debug mode.
+func NewExecutionError(s *Session, r *RequestRPC, err error) *ResponseError {
+	full := strings.TrimSpace(err.Error())
+	et := exceptionType(err)
+	msg := exceptionMessage(err, et)
+	if et == ExceptionTypeInternal {
+		log.Warn("Execution error", "method", r.Method, "error", full)
+	}
+	data := JSONRPCErrorData{
+		Arguments:     msg,
+		Message:       msg,
+		ExceptionType: et,
+	}
+	if s != nil && s.Service != nil && s.Service.Debug {
+		data.Debug = full
+	}
+	return NewResponseError(r, ErrorCodeServer, "Hexya Server Error", data)
+}
+
+// exceptionType returns the exception type of the given execution error.
+// Errors that are not known to be access, validation or user errors are
+// internal errors.
+func exceptionType(err error) string {
+	var et ExceptionTyper
+	if errors.As(err, &et) {
+		return et.ExceptionType()
+	}
+	if errors.Is(err, ErrAccessDenied) {
+		return ExceptionTypeAccess
+	}
+	if errors.Is(err, ErrValidation) {
+		return ExceptionTypeValidation
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code == "42501":
+			return ExceptionTypeAccess
+		case pqErr.Code.Class() == "23":
+			return ExceptionTypeValidation
+		}
+		return ExceptionTypeInternal
+	}
+	return messageExceptionType(firstLine(err.Error()))
+}
+
+// messageExceptionType returns the exception type of an error given the
+// first line of its message, as for the errors recovered by Hexya.
+func messageExceptionType(msg string) string {
+	if strings.HasPrefix(msg, hexyaAccessPrefix) {
+		return ExceptionTypeAccess
+	}
+	for _, marker := range validationMarkers {
+		if strings.Contains(msg, marker) {
+			return ExceptionTypeValidation
+		}
+	}
+	return ExceptionTypeInternal
+}
+
+// firstLine returns the first line of msg, without surrounding spaces
+func firstLine(msg string) string {
+	msg = strings.TrimSpace(msg)
+	if i := strings.Index(msg, "\n"); i >= 0 {
+		msg = strings.TrimSpace(msg[:i])
+	}
+	return msg
+}
+
+// exceptionMessage returns the message sent to the client for the given
+// execution error of type et. Only the first line of the errors that
+// carry their own type or are recognized by their message is sent. Other
+// errors get a generic message, so that neither SQL statements nor
+// internal details reach the client.
+func exceptionMessage(err error, et string) string {
+	var typed ExceptionTyper
+	if errors.As(err, &typed) {
+		return firstLine(typed.Error())
+	}
+	if msg := firstLine(err.Error()); et != ExceptionTypeInternal && messageExceptionType(msg) == et {
+		return msg
+	}
+	switch et {
+	case ExceptionTypeAccess:
+		return ErrAccessDenied.Error()
+	case ExceptionTypeValidation:
+		return ErrValidation.Error()
+	}
+	return "Internal server error"
+}
@@ -0,0 +1,102 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// recoveredError returns the text of the error returned by Hexya when a
+// query panics in an environment: the message of the panic with its
+// context, then the stack of the panic.
+func recoveredError(msg, query string) string {
+	text := msg + "\n"
+	if query != "" {
+		text += "query: " + query + "\nargs: [1]\n"
+	}
+	return text + "\ngoroutine 42 [running]:\nruntime/debug.Stack(0xc0004a2000, 0x1, 0x1)\n\t/usr/local/go/src/runtime/debug/stack.go:24 +0x9d\n"
+}
+
+func TestExceptionType(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		exType  string
+		message string
+	}{
+		{"plain", errors.New("boom"), ExceptionTypeInternal, "Internal server error"},
+		{"sql", errors.New("pq: syntax error at or near \"FROM\"\nSELECT * FROM users"),
+			ExceptionTypeInternal, "Internal server error"},
+		{"runtime", errors.New("runtime error: index out of range"), ExceptionTypeInternal, "Internal server error"},
+		{"access sentinel", fmt.Errorf("write partner: %w", ErrAccessDenied), ExceptionTypeAccess, "Access denied"},
+		{"validation sentinel", fmt.Errorf("bad vals: %w", ErrValidation), ExceptionTypeValidation, "Invalid data"},
+		{"hexya access", errors.New("You are not allowed to execute this method\nmodel=User"),
+			ExceptionTypeAccess, "You are not allowed to execute this method"},
+		{"pq unique", &pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"},
+			ExceptionTypeValidation, "pq: duplicate key value violates unique constraint"},
+		{"pq privilege", &pq.Error{Code: "42501", Message: "permission denied for table users"},
+			ExceptionTypeAccess, "Access denied"},
+		{"pq other", &pq.Error{Code: "42P01", Message: "relation does not exist"}, ExceptionTypeInternal, "Internal server error"},
+		{"user", &UserError{Message: "Name is required\ndetails"}, ExceptionTypeUser, "Name is required"},
+		{"wrapped user", fmt.Errorf("create: %w", &UserError{Message: "Name is required"}), ExceptionTypeUser, "Name is required"},
+		{"recovered unique", errors.New(recoveredError(`pq: duplicate key value violates unique constraint "device_firmware_device_type_version_unique"`,
+			`INSERT INTO "device_firmware" ("name", "device_type", "version") VALUES ($1, $2, $3) RETURNING id`)),
+			ExceptionTypeValidation, `pq: duplicate key value violates unique constraint "device_firmware_device_type_version_unique"`},
+		{"recovered not null", errors.New(recoveredError(`pq: null value in column "name" violates not-null constraint`,
+			`INSERT INTO "device" ("ulid") VALUES ($1) RETURNING id`)),
+			ExceptionTypeValidation, `pq: null value in column "name" violates not-null constraint`},
+		{"recovered foreign key", errors.New(recoveredError(`pq: insert or update on table "firmware_update" violates foreign key constraint "firmware_update_device_id_fkey"`,
+			`INSERT INTO "firmware_update" ("device_id") VALUES ($1) RETURNING id`)),
+			ExceptionTypeValidation, `pq: insert or update on table "firmware_update" violates foreign key constraint "firmware_update_device_id_fkey"`},
+		{"recovered validation", errors.New(recoveredError("ValidationError: End date must be after start date", "")),
+			ExceptionTypeValidation, "ValidationError: End date must be after start date"},
+		{"recovered access", errors.New(recoveredError("You are not allowed to execute method Write on model Device", "")),
+			ExceptionTypeAccess, "You are not allowed to execute method Write on model Device"},
+		{"recovered sql", errors.New(recoveredError(`pq: relation "device" does not exist`, `SELECT id FROM "device"`)),
+			ExceptionTypeInternal, "Internal server error"},
+		{"constraint in query only", errors.New(recoveredError("pq: syntax error",
+			"ALTER TABLE x ADD CONSTRAINT y -- violates unique constraint")),
+			ExceptionTypeInternal, "Internal server error"},
+		{"conflict", &ConflictError{Model: "Partner"}, ExceptionTypeConflict, "Record of Partner has been modified by another user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			et := exceptionType(tt.err)
+			if et != tt.exType {
+				t.Errorf("exceptionType() = %q, want %q", et, tt.exType)
+			}
+			if msg := exceptionMessage(tt.err, et); msg != tt.message {
+				t.Errorf("exceptionMessage() = %q, want %q", msg, tt.message)
+			}
+		})
+	}
+}
+
+func TestHandlersDenyAnonymousSessions(t *testing.T) {
+	handlers := map[string]JsonRPCHandleFunc{
+		"call_kw":         JsonRPCCallKW,
+		"execute_batch":   JsonRPCExecuteBatch,
+		"subscribe":       JsonRPCSubscribe,
+		"upload_begin":    JsonRPCUploadBegin,
+		"telemetry_query": JsonRPCTelemetryQuery,
+		"device_command":  JsonRPCDeviceCommand,
+		"shadow_desire":   JsonRPCShadowDesire,
+		"download":        JsonRPCDownload,
+		"download_report": JsonRPCDownloadReport,
+	}
+	for method, handler := range handlers {
+		s, _ := newTestSession(nil)
+		r := &RequestRPC{JsonRPC: "2.0", ID: 7, Method: method}
+		result, err := handler(s, r)
+		if err != nil {
+			t.Errorf("%s: error = %v, want a response", method, err)
+			continue
+		}
+		response, ok := result.(*ResponseError)
+		if !ok || response.ID != r.ID || response.Error.Code != int(ErrorCodeAccessDenied) {
+			t.Errorf("%s: response = %+v, want an access denied error", method, result)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	hc "github.com/hexya-addons/web/controllers"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/server"
+)
+
+// BatchParams is the format of the parameters of execute_batch
+type BatchParams struct {
+	Calls []hc.CallParams `json:"calls"`
+}
+
+// A reference to the result of a previous call of a batch is an object
+// such as {"$ref": 0, "path": "id"}. Path is optional.
+const (
+	referenceKey     = "$ref"
+	referencePathKey = "path"
+)
+
+// JsonRPCExecuteBatch executes the given list of calls in a single
+// transaction. The arguments of a call may reference the result of a
+// previous call with {"$ref": <index>} or {"$ref": <index>, "path": <key>}
+// (e.g. {"$ref": 0, "path": "id"}).
+//
+// If a call fails, the whole transaction is rolled back and the returned
+// error carries the index of the failing call. Otherwise, the subscribers
+// of the modified records are notified.
+func JsonRPCExecuteBatch(s *Session, r *RequestRPC) (interface{}, error) {
+	uid := s.UID
+	if uid == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
+	}
+	if r.Params == nil {
+		return NewResponseError(r, ErrorCodeInvalidParams, "Missing batch parameters", nil), nil
+	}
+	var params BatchParams
+	err := json.Unmarshal(*r.Params, &params.Calls)
+	if err != nil {
+		err = json.Unmarshal(*r.Params, &params)
+	}
+	if err != nil {
+		return nil, errors.New("JsonRPCExecuteBatch error: Invalid format")
+	}
+
+	results := make([]interface{}, 0, len(params.Calls))
+	var step int
+	err = models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		for i, call := range params.Calls {
+			step = i
+			for j, arg := range call.Args {
+				resolved, rErr := resolveReferences(arg, results)
+				if rErr != nil {
+					log.Panic(rErr.Error(), "step", i)
+				}
+				call.Args[j] = resolved
+			}
+			for k, kwarg := range call.KWArgs {
+				resolved, rErr := resolveReferences(kwarg, results)
+				if rErr != nil {
+					log.Panic(rErr.Error(), "step", i)
+				}
+				call.KWArgs[k] = resolved
+			}
+			results = append(results, executeInEnvironment(env, call))
+		}
+	})
+	if err != nil {
+		response := NewExecutionError(s, r, err)
+		data := response.Error.Data.(JSONRPCErrorData)
+		data.Index = &step
+		response.Error.Data = data
+		return response, nil
+	}
+	for i, call := range params.Calls {
+		publishRecordChanges(uid, call, results[i])
+	}
+
+	response := &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  results,
+	}
+	return response, nil
+}
+
+// executeCall calls the method given by params in a new environment of the
+// given user and returns its result in a JSON friendly form. It is the
+// single implementation of the calls of call_kw, call_button and
+// execute_batch.
+func executeCall(uid int64, params hc.CallParams) (interface{}, error) {
+	var res interface{}
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		res = executeInEnvironment(env, params)
+	})
+	return res, err
+}
+
+// executeInEnvironment calls the method given by params in env and returns
+// its result in a JSON friendly form. Record sets are returned as ids.
+//
+// Unlike hc.Execute, it does not create a new environment so that several
+// calls may share the same transaction.
+func executeInEnvironment(env models.Environment, params hc.CallParams) interface{} {
+	rc := env.Pool(params.Model)
+	method := methodName(params.Method)
+	args := params.Args
+
+	// First argument may be the id or ids of the records
+	var single bool
+	if len(args) > 0 {
+		var ids []int64
+		var id int64
+		if err := json.Unmarshal(args[0], &ids); err == nil {
+			rc = rc.Call("Browse", ids).(models.RecordSet).Collection()
+			args = args[1:]
+		} else if err := json.Unmarshal(args[0], &id); err == nil {
+			rc = rc.Call("Browse", []int64{id}).(models.RecordSet).Collection()
+			args = args[1:]
+			single = true
+		}
+	}
+
+	if ctxJSON, ok := params.KWArgs["context"]; ok {
+		var ctx types.Context
+		if err := json.Unmarshal(ctxJSON, &ctx); err == nil {
+			rc = rc.WithNewContext(&ctx)
+		}
+	}
+
+	fnType := rc.MethodType(method)
+	var parms []interface{}
+	if fnType.NumIn() > 1 && fnType.In(1).Kind() == reflect.Struct {
+		// Method takes a struct of parameters: parse kwargs into it
+		kwargs := make(map[string]json.RawMessage)
+		for k, v := range params.KWArgs {
+			if k != "context" {
+				kwargs[k] = v
+			}
+		}
+		data, _ := json.Marshal(kwargs)
+		arg := reflect.New(fnType.In(1))
+		if err := json.Unmarshal(data, arg.Interface()); err != nil {
+			log.Panic("Unable to parse method parameters", "method", method, "error", err)
+		}
+		parms = append(parms, arg.Elem().Interface())
+	} else {
+		for i, a := range args {
+			if i+1 >= fnType.NumIn() {
+				break
+			}
+			parms = append(parms, unmarshalArg(a, fnType.In(i+1)))
+		}
+	}
+
+	res := rc.Call(method, parms...)
+	if rs, ok := res.(models.RecordSet); ok {
+		ids := rs.Ids()
+		if (single || method == "Create") && len(ids) == 1 {
+			return ids[0]
+		}
+		return ids
+	}
+	return res
+}
+
+// unmarshalArg returns the given JSON argument parsed into the given type
+func unmarshalArg(data json.RawMessage, typ reflect.Type) interface{} {
+	if typ == reflect.TypeOf((*models.FieldMapper)(nil)).Elem() {
+		var fm models.FieldMap
+		if err := json.Unmarshal(data, &fm); err != nil {
+			log.Panic("Unable to parse method argument", "type", typ, "error", err)
+		}
+		return fm
+	}
+	arg := reflect.New(typ)
+	if err := json.Unmarshal(data, arg.Interface()); err != nil {
+		log.Panic("Unable to parse method argument", "type", typ, "error", err)
+	}
+	return arg.Elem().Interface()
+}
+
+// methodName converts a method name sent by the client (e.g. search_read)
+// to the Hexya method name (e.g. SearchRead).
+func methodName(name string) string {
+	var res string
+	for _, part := range strings.Split(name, "_") {
+		if part == "" {
+			continue
+		}
+		res += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return res
+}
+
+// resolveReferences returns a copy of the given JSON value in which all
+// references to previous results are replaced by their value.
+func resolveReferences(data json.RawMessage, results []interface{}) (json.RawMessage, error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	resolved, err := resolveValue(value, results)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resolved)
+}
+
+// resolveValue recursively replaces references in the given decoded JSON value
+func resolveValue(value interface{}, results []interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		for i, item := range v {
+			r, err := resolveValue(item, results)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = r
+		}
+	case map[string]interface{}:
+		if _, ok := v[referenceKey]; ok {
+			return resolveReference(v, results)
+		}
+		for k, item := range v {
+			r, err := resolveValue(item, results)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = r
+		}
+	}
+	return value, nil
+}
+
+// resolveReference returns the value referenced by the given reference
+// object
+func resolveReference(ref map[string]interface{}, results []interface{}) (interface{}, error) {
+	for k := range ref {
+		if k != referenceKey && k != referencePathKey {
+			return nil, fmt.Errorf("invalid reference: unknown member %s", k)
+		}
+	}
+	index, ok := ref[referenceKey].(float64)
+	if !ok || index < 0 || index != math.Trunc(index) {
+		return nil, fmt.Errorf("invalid reference: %s must be a step index", referenceKey)
+	}
+	if index >= float64(len(results)) {
+		return nil, fmt.Errorf("invalid reference: step %v has not been executed", index)
+	}
+	var path string
+	if p, ok := ref[referencePathKey]; ok {
+		if path, ok = p.(string); !ok {
+			return nil, fmt.Errorf("invalid reference: %s must be a string", referencePathKey)
+		}
+	}
+	res, err := jsonValue(results[int(index)])
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			continue
+		}
+		if res, err = lookupKey(res, key); err != nil {
+			return nil, fmt.Errorf("invalid reference to step %d: %s", int(index), err)
+		}
+	}
+	return res, nil
+}
+
+// lookupKey returns the value of key in the given decoded JSON value.
+//
+// A number is a record id and "id" returns the number itself. A list with a
+// single element is a list of ids and any key is looked up in its element.
+func lookupKey(value interface{}, key string) (interface{}, error) {
+	switch v := value.(type) {
+	case float64:
+		if key == "id" {
+			return v, nil
+		}
+	case []interface{}:
+		if i, err := strconv.Atoi(key); err == nil {
+			if i >= 0 && i < len(v) {
+				return v[i], nil
+			}
+			return nil, fmt.Errorf("index %d out of range", i)
+		}
+		if len(v) == 1 {
+			return lookupKey(v[0], key)
+		}
+	case map[string]interface{}:
+		if r, ok := v[key]; ok {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %s", key)
+}
+
+// jsonValue returns the given value as decoded JSON
+func jsonValue(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var res interface{}
+	err = json.Unmarshal(data, &res)
+	return res, err
+}
@@ -0,0 +1,77 @@
+package websocket
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestResolveValue(t *testing.T) {
+	results := []interface{}{
+		int64(7),
+		[]int64{3, 4},
+		map[string]interface{}{"id": 9, "name": "Agrolait"},
+		[]int64{5},
+	}
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"plain values", `[1, "$0", {"a": "b"}]`, `[1,"$0",{"a":"b"}]`, false},
+		{"whole result", `{"$ref": 0}`, `7`, false},
+		{"id of single id", `{"$ref": 0, "path": "id"}`, `7`, false},
+		{"list index", `{"$ref": 1, "path": "1"}`, `4`, false},
+		{"single element list", `{"$ref": 3, "path": "id"}`, `5`, false},
+		{"object key", `{"$ref": 2, "path": "name"}`, `"Agrolait"`, false},
+		{"nested", `[[{"$ref": 0}], {"partner_id": {"$ref": 2, "path": "id"}}]`, `[[7],{"partner_id":9}]`, false},
+		{"future step", `{"$ref": 4}`, ``, true},
+		{"negative step", `{"$ref": -1}`, ``, true},
+		{"fractional step", `{"$ref": 0.5}`, ``, true},
+		{"string step", `{"$ref": "0"}`, ``, true},
+		{"huge step", `{"$ref": 1e30}`, ``, true},
+		{"non string path", `{"$ref": 0, "path": 1}`, ``, true},
+		{"unknown member", `{"$ref": 0, "id": 1}`, ``, true},
+		{"negative index", `{"$ref": 1, "path": "-1"}`, ``, true},
+		{"index out of range", `{"$ref": 1, "path": "2"}`, ``, true},
+		{"unknown key", `{"$ref": 2, "path": "email"}`, ``, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value interface{}
+			if err := json.Unmarshal([]byte(tt.value), &value); err != nil {
+				t.Fatal(err)
+			}
+			got, err := resolveValue(value, results)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveValue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var want interface{}
+			json.Unmarshal([]byte(tt.want), &want)
+			data, _ := json.Marshal(got)
+			var gotValue interface{}
+			json.Unmarshal(data, &gotValue)
+			if !reflect.DeepEqual(gotValue, want) {
+				t.Errorf("resolveValue() = %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestMethodName(t *testing.T) {
+	tests := map[string]string{
+		"search_read":  "SearchRead",
+		"write":        "Write",
+		"name_get":     "NameGet",
+		"_private__op": "PrivateOp",
+	}
+	for in, want := range tests {
+		if got := methodName(in); got != want {
+			t.Errorf("methodName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,562 @@
+package websocket
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/server"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+)
+
+// States of firmware rollouts
+const (
+	RolloutDraft   = "draft"
+	RolloutRunning = "running"
+	RolloutPaused  = "paused"
+	RolloutDone    = "done"
+)
+
+// States of the firmware update of a device
+const (
+	UpdatePending     = "pending"
+	UpdateOffered     = "offered"
+	UpdateDownloading = "downloading"
+	UpdateInstalling  = "installing"
+	UpdateSucceeded   = "succeeded"
+	UpdateFailed      = "failed"
+)
+
+const (
+	// FirmwareAvailableMethod is the notification method offering a
+	// firmware update to a device
+	FirmwareAvailableMethod = "firmware_available"
+	// DefaultRolloutStages are the default percentages of the devices of
+	// a rollout that are updated at each stage
+	DefaultRolloutStages = "10,50,100"
+	// FirmwareCacheSize is the maximum total size in bytes of the firmware
+	// images kept in memory
+	FirmwareCacheSize = 64 << 20
+)
+
+// FirmwareOffer is the params of the firmware_available notification
+type FirmwareOffer struct {
+	UpdateID   int64  `json:"update_id"`
+	DeviceType string `json:"device_type"`
+	Version    string `json:"version"`
+	Size       int64  `json:"size"`
+	Checksum   string `json:"checksum"`
+}
+
+// FirmwareStatusParams is the format of the parameters of firmware_download
+// and firmware_status. Progress is a percentage.
+type FirmwareStatusParams struct {
+	UpdateID int64   `json:"update_id"`
+	State    string  `json:"state"`
+	Progress float64 `json:"progress"`
+	Error    string  `json:"error"`
+}
+
+// A firmwareImage is the content of a firmware attachment
+type firmwareImage struct {
+	content  []byte
+	checksum string
+}
+
+// A firmwareCacheEntry is a cached firmware image
+type firmwareCacheEntry struct {
+	firmwareID   int64
+	attachmentID int64
+	image        *firmwareImage
+}
+
+// A firmwareCache keeps the most recently used firmware images, up to a
+// total size. Only the latest attachment of a firmware is kept.
+type firmwareCache struct {
+	mutex   sync.Mutex
+	maxSize int
+	size    int
+	entries map[int64]*list.Element
+	// order holds the entries, most recently used first
+	order *list.List
+}
+
+// newFirmwareCache returns a cache of at most maxSize bytes of images
+func newFirmwareCache(maxSize int) *firmwareCache {
+	return &firmwareCache{
+		maxSize: maxSize,
+		entries: make(map[int64]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the cached image of the given attachment, or nil
+func (c *firmwareCache) get(attachmentID int64) *firmwareImage {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elt, ok := c.entries[attachmentID]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(elt)
+	return elt.Value.(*firmwareCacheEntry).image
+}
+
+// put caches the image of the given attachment of a firmware. The images
+// of the other attachments of the firmware are evicted, as well as the
+// least recently used images beyond the size of the cache. Images larger
+// than the cache are not cached.
+func (c *firmwareCache) put(firmwareID, attachmentID int64, image *firmwareImage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, elt := range c.entries {
+		if entry := elt.Value.(*firmwareCacheEntry); entry.firmwareID == firmwareID {
+			c.remove(elt)
+		}
+	}
+	if len(image.content) > c.maxSize {
+		return
+	}
+	c.entries[attachmentID] = c.order.PushFront(&firmwareCacheEntry{
+		firmwareID:   firmwareID,
+		attachmentID: attachmentID,
+		image:        image,
+	})
+	c.size += len(image.content)
+	for c.size > c.maxSize {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove removes the given element from the cache. c must be locked.
+func (c *firmwareCache) remove(elt *list.Element) {
+	entry := c.order.Remove(elt).(*firmwareCacheEntry)
+	delete(c.entries, entry.attachmentID)
+	c.size -= len(entry.image.content)
+}
+
+// firmwareImages caches the content of firmware attachments by attachment ID
+// so that a rollout does not decode the attachment for each device.
+var firmwareImages = newFirmwareCache(FirmwareCacheSize)
+
+// loadFirmwareImage returns the content of the latest attachment of the
+// given firmware and records its size and checksum on the firmware.
+func loadFirmwareImage(firmware h.DeviceFirmwareSet) *firmwareImage {
+	attachment := h.Attachment().Search(firmware.Env(),
+		q.Attachment().ResModel().Equals("DeviceFirmware").And().ResID().Equals(firmware.ID())).
+		OrderBy("ID DESC").Limit(1)
+	if attachment.IsEmpty() {
+		log.Panic("Firmware has no image", "firmware", firmware.ID())
+	}
+	if image := firmwareImages.get(attachment.ID()); image != nil {
+		return image
+	}
+	content := fieldContent(attachment.Datas())
+	sum := sha256.Sum256(content)
+	image := &firmwareImage{
+		content:  content,
+		checksum: hex.EncodeToString(sum[:]),
+	}
+	firmwareImages.put(firmware.ID(), attachment.ID(), image)
+	if firmware.Checksum() != image.checksum {
+		firmware.Write(&h.DeviceFirmwareData{
+			Size:     int64(len(content)),
+			Checksum: image.checksum,
+		})
+	}
+	return image
+}
+
+// parseRolloutStages returns the percentages of the given stages string
+func parseRolloutStages(stages string) []float64 {
+	var res []float64
+	for _, stage := range strings.Split(stages, ",") {
+		pct, err := strconv.ParseFloat(strings.TrimSpace(stage), 64)
+		if err != nil || pct <= 0 {
+			continue
+		}
+		res = append(res, math.Min(pct, 100))
+	}
+	if len(res) == 0 || res[len(res)-1] < 100 {
+		res = append(res, 100)
+	}
+	return res
+}
+
+// publishFirmwareUpdate notifies the subscribers of the given update and of
+// its rollout
+func publishFirmwareUpdate(update h.FirmwareUpdateSet) {
+	PublishAll(RecordChangedMethod, &RecordChange{
+		Model:     "FirmwareUpdate",
+		Operation: "write",
+		ID:        update.ID(),
+		UID:       security.SuperUserID,
+	}, RecordTopic("FirmwareUpdate", update.ID()), RecordTopic("FirmwareUpdate", 0))
+	PublishAll(RecordChangedMethod, &RecordChange{
+		Model:     "FirmwareRollout",
+		Operation: "write",
+		ID:        update.Rollout().ID(),
+		UID:       security.SuperUserID,
+	}, RecordTopic("FirmwareRollout", update.Rollout().ID()), RecordTopic("FirmwareRollout", 0))
+}
+
+// offerFirmware notifies the device of the given update if it is online
+func offerFirmware(update h.FirmwareUpdateSet) {
+	sessions := deviceSessions(update.Device().ID())
+	if len(sessions) == 0 {
+		return
+	}
+	firmware := update.Rollout().Firmware()
+	image := loadFirmwareImage(firmware)
+	offer := &FirmwareOffer{
+		UpdateID:   update.ID(),
+		DeviceType: firmware.DeviceType(),
+		Version:    firmware.Version(),
+		Size:       int64(len(image.content)),
+		Checksum:   image.checksum,
+	}
+	for _, session := range sessions {
+		session.Notify(FirmwareAvailableMethod, offer)
+	}
+}
+
+// advanceRollout offers the firmware to the pending devices of the current
+// stage of the given rollout and returns the number of devices it offered
+// the firmware to.
+func advanceRollout(rollout h.FirmwareRolloutSet) int {
+	stages := parseRolloutStages(rollout.Stages())
+	stage := int(rollout.Stage())
+	if stage >= len(stages) {
+		stage = len(stages) - 1
+	}
+	updates := rollout.Updates().OrderBy("ID")
+	target := int(math.Ceil(stages[stage] * float64(updates.Len()) / 100))
+	var started, offered int
+	for _, update := range updates.Records() {
+		if update.State() != UpdatePending {
+			started++
+		}
+	}
+	for _, update := range updates.Records() {
+		if started >= target {
+			break
+		}
+		if update.State() != UpdatePending {
+			continue
+		}
+		update.Write(&h.FirmwareUpdateData{
+			State:     UpdateOffered,
+			StartDate: dates.Now(),
+		})
+		offerFirmware(update)
+		publishFirmwareUpdate(update)
+		started++
+		offered++
+	}
+	return offered
+}
+
+// checkRollout is called when an update of the given rollout is finished.
+// It pauses the rollout if the update failed and the failure rate crosses
+// the threshold of the rollout, or moves the rollout to its next stage when
+// all the started updates are finished.
+func checkRollout(rollout h.FirmwareRolloutSet, updateFailed bool) {
+	if rollout.State() != RolloutRunning {
+		return
+	}
+	var finished, failed, pending int
+	for _, update := range rollout.Updates().Records() {
+		switch update.State() {
+		case UpdateSucceeded:
+			finished++
+		case UpdateFailed:
+			finished++
+			failed++
+		case UpdatePending:
+			pending++
+		}
+	}
+	total := rollout.Updates().Len()
+	if updateFailed && int64(finished) >= rollout.MinSamples() &&
+		float64(failed)*100 > rollout.FailureThreshold()*float64(finished) {
+		rollout.Write(&h.FirmwareRolloutData{
+			State:       RolloutPaused,
+			PauseReason: fmt.Sprintf("%d of %d updates failed", failed, finished),
+		})
+		log.Warn("Firmware rollout paused", "rollout", rollout.ID(), "failed", failed, "finished", finished)
+		return
+	}
+	if finished < total-pending {
+		return
+	}
+	if pending == 0 {
+		rollout.SetState(RolloutDone)
+		return
+	}
+	// Small rollouts may have stages that do not add any device
+	last := int64(len(parseRolloutStages(rollout.Stages())) - 1)
+	for stage := rollout.Stage(); ; {
+		if stage < last {
+			stage++
+			rollout.SetStage(stage)
+		}
+		if advanceRollout(rollout) > 0 || stage >= last {
+			break
+		}
+	}
+}
+
+// offerDeviceFirmware offers again the unfinished updates of a device that
+// has just logged in.
+func offerDeviceFirmware(deviceID int64) {
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		updates := h.FirmwareUpdate().Search(env,
+			q.FirmwareUpdate().Device().Equals(h.Device().Browse(env, []int64{deviceID})).
+				And().State().In([]string{UpdateOffered, UpdateDownloading}))
+		for _, update := range updates.Records() {
+			offerFirmware(update)
+		}
+	})
+	if err != nil {
+		log.Warn("Unable to offer firmware", "device", deviceID, "error", err)
+	}
+}
+
+// deviceUpdate returns the firmware update with the given ID of the device
+// of the session. It panics if the update belongs to another device.
+func deviceUpdate(env models.Environment, s *Session, updateID int64) h.FirmwareUpdateSet {
+	update := h.FirmwareUpdate().Search(env, q.FirmwareUpdate().ID().Equals(updateID))
+	if update.IsEmpty() || update.Device().ID() != s.DeviceID {
+		log.Panic("Firmware update not found", "update", updateID)
+	}
+	return update
+}
+
+// JsonRPCFirmwareDownload prepares the download of the firmware of an update
+// offered to the device of the session. The image is then streamed as with
+// download: the device calls download_ack with the offset it already has,
+// which lets it resume an interrupted download.
+func JsonRPCFirmwareDownload(s *Session, r *RequestRPC) (interface{}, error) {
+	if s.DeviceID == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, "Access denied", nil), nil
+	}
+	var params FirmwareStatusParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return nil, errors.New("JsonRPCFirmwareDownload error: Invalid format")
+	}
+	var (
+		image *firmwareImage
+		name  string
+	)
+	err = models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		update := deviceUpdate(env, s, params.UpdateID)
+		switch update.State() {
+		case UpdateOffered, UpdateDownloading:
+		default:
+			log.Panic("Firmware update is not offered", "update", update.ID(), "state", update.State())
+		}
+		firmware := update.Rollout().Firmware()
+		image = loadFirmwareImage(firmware)
+		name = fmt.Sprintf("%s-%s", firmware.DeviceType(), firmware.Version())
+		update.SetState(UpdateDownloading)
+		publishFirmwareUpdate(update)
+	})
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	dl, err := newDownload(s, image.content, name, "application/octet-stream")
+	if err != nil {
+		return NewResponseError(r, ErrorCodeRateLimited, err.Error(), nil), nil
+	}
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  &dl.DownloadStatus,
+	}, nil
+}
+
+// JsonRPCFirmwareStatus records the progress or the final status of a
+// firmware update reported by the device of the session.
+func JsonRPCFirmwareStatus(s *Session, r *RequestRPC) (interface{}, error) {
+	if s.DeviceID == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, "Access denied", nil), nil
+	}
+	var params FirmwareStatusParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return nil, errors.New("JsonRPCFirmwareStatus error: Invalid format")
+	}
+	switch params.State {
+	case UpdateDownloading, UpdateInstalling, UpdateSucceeded, UpdateFailed:
+	default:
+		return NewResponseError(r, ErrorCodeInvalidParams, "Invalid state: "+params.State, nil), nil
+	}
+	err = models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		// Lock the rollout so that concurrent reports are counted once
+		env.Cr().Execute(fmt.Sprintf("SELECT id FROM %s WHERE id = (SELECT rollout_id FROM %s WHERE id = ?) FOR UPDATE",
+			h.FirmwareRollout().TableName(), h.FirmwareUpdate().TableName()), params.UpdateID)
+		update := deviceUpdate(env, s, params.UpdateID)
+		switch update.State() {
+		case UpdateSucceeded, UpdateFailed, UpdatePending:
+			log.Panic("Firmware update is not in progress", "update", update.ID(), "state", update.State())
+		}
+		data := &h.FirmwareUpdateData{
+			State:    params.State,
+			Progress: math.Max(0, math.Min(params.Progress, 100)),
+			Error:    params.Error,
+		}
+		finished := params.State == UpdateSucceeded || params.State == UpdateFailed
+		if finished {
+			data.EndDate = dates.Now()
+		}
+		if params.State == UpdateSucceeded {
+			data.Progress = 100
+			update.Device().SetFirmware(update.Rollout().Firmware().Version())
+		}
+		update.Write(data)
+		publishFirmwareUpdate(update)
+		if finished {
+			checkRollout(update.Rollout(), params.State == UpdateFailed)
+		}
+	})
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  true,
+	}, nil
+}
+
+func init() {
+	firmwareModel := h.DeviceFirmware().DeclareModel()
+	firmwareModel.AddFields(map[string]models.FieldDefinition{
+		"Name":       models.CharField{String: "Name", Required: true},
+		"DeviceType": models.CharField{String: "Device Type", Required: true, Index: true},
+		"Version":    models.CharField{String: "Version", Required: true},
+		"Notes":      models.TextField{String: "Release Notes"},
+		"Size":       models.IntegerField{String: "Size", GoType: new(int64), ReadOnly: true},
+		"Checksum": models.CharField{String: "Checksum", ReadOnly: true, NoCopy: true,
+			Help: "SHA-256 checksum of the firmware image, the latest attachment of the firmware"},
+	})
+	firmwareModel.AddSQLConstraint("device_type_version_unique", "unique(device_type, version)",
+		"A firmware with this version already exists for this device type")
+	firmwareModel.SetDefaultOrder("DeviceType", "ID DESC")
+
+	rolloutModel := h.FirmwareRollout().DeclareModel()
+	rolloutModel.AddFields(map[string]models.FieldDefinition{
+		"Name": models.CharField{String: "Name", Required: true},
+		"Firmware": models.Many2OneField{String: "Firmware", RelationModel: h.DeviceFirmware(),
+			Required: true, OnDelete: models.Restrict},
+		"Devices": models.Many2ManyField{String: "Devices", RelationModel: h.Device(),
+			Help: "Devices of another type than the firmware are ignored"},
+		"Updates": models.One2ManyField{String: "Updates", RelationModel: h.FirmwareUpdate(),
+			ReverseFK: "Rollout"},
+		"State": models.SelectionField{String: "State", Required: true, Index: true,
+			Selection: types.Selection{
+				RolloutDraft:   "Draft",
+				RolloutRunning: "Running",
+				RolloutPaused:  "Paused",
+				RolloutDone:    "Done",
+			},
+			Default: models.DefaultValue(RolloutDraft),
+		},
+		"Stages": models.CharField{String: "Stages",
+			Help:    "Comma separated percentages of the devices updated at each stage",
+			Default: models.DefaultValue(DefaultRolloutStages),
+		},
+		"Stage": models.IntegerField{String: "Current Stage", GoType: new(int64)},
+		"FailureThreshold": models.FloatField{String: "Failure Threshold",
+			Help:    "Percentage of failed updates above which the rollout is paused",
+			Default: models.DefaultValue(10.0),
+		},
+		"MinSamples": models.IntegerField{String: "Minimum Samples", GoType: new(int64),
+			Help:    "Number of finished updates before the failure threshold is checked",
+			Default: models.DefaultValue(int64(5)),
+		},
+		"PauseReason": models.CharField{String: "Pause Reason"},
+	})
+	rolloutModel.SetDefaultOrder("ID DESC")
+
+	rolloutModel.AddMethod("ActionStart",
+		`ActionStart starts the rollout, or resumes it if it is paused.`,
+		func(rs h.FirmwareRolloutSet) bool {
+			for _, rollout := range rs.Records() {
+				switch rollout.State() {
+				case RolloutDraft:
+					deviceType := rollout.Firmware().DeviceType()
+					for _, device := range rollout.Devices().Records() {
+						if device.DeviceType() != deviceType {
+							continue
+						}
+						h.FirmwareUpdate().Create(rollout.Env(), &h.FirmwareUpdateData{
+							Rollout: rollout,
+							Device:  device,
+						})
+					}
+					rollout.Write(&h.FirmwareRolloutData{State: RolloutRunning})
+				case RolloutPaused:
+					rollout.Write(&h.FirmwareRolloutData{State: RolloutRunning}, h.FirmwareRollout().PauseReason())
+				default:
+					continue
+				}
+				advanceRollout(rollout)
+				checkRollout(rollout, false)
+			}
+			return true
+		})
+
+	rolloutModel.AddMethod("ActionPause",
+		`ActionPause stops offering the firmware to new devices. The updates in
+		progress go on.`,
+		func(rs h.FirmwareRolloutSet) bool {
+			for _, rollout := range rs.Records() {
+				if rollout.State() == RolloutRunning {
+					rollout.Write(&h.FirmwareRolloutData{
+						State:       RolloutPaused,
+						PauseReason: "Paused manually",
+					})
+				}
+			}
+			return true
+		})
+
+	updateModel := h.FirmwareUpdate().DeclareModel()
+	updateModel.AddFields(map[string]models.FieldDefinition{
+		"Rollout": models.Many2OneField{String: "Rollout", RelationModel: h.FirmwareRollout(),
+			Required: true, Index: true, OnDelete: models.Cascade},
+		"Device": models.Many2OneField{String: "Device", RelationModel: h.Device(),
+			Required: true, Index: true, OnDelete: models.Cascade},
+		"State": models.SelectionField{String: "State", Required: true, Index: true,
+			Selection: types.Selection{
+				UpdatePending:     "Pending",
+				UpdateOffered:     "Offered",
+				UpdateDownloading: "Downloading",
+				UpdateInstalling:  "Installing",
+				UpdateSucceeded:   "Succeeded",
+				UpdateFailed:      "Failed",
+			},
+			Default: models.DefaultValue(UpdatePending),
+		},
+		"Progress":  models.FloatField{String: "Progress"},
+		"Error":     models.TextField{String: "Error"},
+		"StartDate": models.DateTimeField{String: "Started"},
+		"EndDate":   models.DateTimeField{String: "Finished"},
+	})
+	updateModel.AddSQLConstraint("rollout_device_unique", "unique(rollout_id, device_id)",
+		"A device can be updated only once per rollout")
+}
@@ -0,0 +1,59 @@
+package websocket
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRolloutStages(t *testing.T) {
+	tests := []struct {
+		stages string
+		want   []float64
+	}{
+		{DefaultRolloutStages, []float64{10, 50, 100}},
+		{"", []float64{100}},
+		{"100", []float64{100}},
+		{" 5 , 25 ", []float64{5, 25, 100}},
+		{"1,x,-5,0,30", []float64{1, 30, 100}},
+		{"50,150", []float64{50, 100}},
+		{"12.5,100", []float64{12.5, 100}},
+	}
+	for _, tt := range tests {
+		if got := parseRolloutStages(tt.stages); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRolloutStages(%q) = %v, want %v", tt.stages, got, tt.want)
+		}
+	}
+}
+
+func TestFirmwareCache(t *testing.T) {
+	image := func(size int) *firmwareImage { return &firmwareImage{content: make([]byte, size)} }
+	c := newFirmwareCache(10)
+
+	c.put(1, 11, image(4))
+	c.put(2, 21, image(4))
+	if c.get(11) == nil || c.get(21) == nil {
+		t.Fatal("cached images not found")
+	}
+	// 11 is now the least recently used
+	c.get(21)
+	c.put(3, 31, image(4))
+	if c.get(11) != nil {
+		t.Error("least recently used image not evicted")
+	}
+	if c.get(21) == nil || c.get(31) == nil {
+		t.Error("recently used images evicted")
+	}
+	// A new attachment of a firmware replaces the previous one
+	c.put(2, 22, image(2))
+	if c.get(21) != nil || c.get(22) == nil {
+		t.Error("previous attachment of the firmware not evicted")
+	}
+	if c.size != 6 || len(c.entries) != 2 || c.order.Len() != 2 {
+		t.Errorf("size = %d with %d entries, want 6 with 2", c.size, len(c.entries))
+	}
+	// Images larger than the cache are not cached
+	c.put(4, 41, image(11))
+	if c.get(41) != nil || c.size != 6 {
+		t.Error("image larger than the cache was cached")
+	}
+}
@@ -2,12 +2,17 @@ module github.com/halybang/hexya-addons/websocket
 
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/gin-gonic/contrib v0.0.0-20190302003538-54ff787f7c73 // indirect
 	github.com/gin-gonic/gin v1.3.0
-	github.com/gorilla/websocket v1.4.0 // indirect
+	github.com/gorilla/websocket v1.4.0
 	github.com/hexya-addons/web v0.0.17
 	github.com/hexya-addons/base v0.0.15
 	github.com/hexya-erp/hexya v0.0.18
+	github.com/lib/pq v1.0.0
 	github.com/oklog/ulid v1.3.1
 	github.com/olahol/melody v0.0.0-20180227134253-7bd65910e5ab
+	github.com/spf13/viper v1.3.1
+	github.com/vmihailenco/msgpack v4.0.4+incompatible
 )
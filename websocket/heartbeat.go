@@ -0,0 +1,66 @@
+package websocket
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+// heartbeat pings the idle clients of the service every HeartbeatInterval
+// and closes the sessions that stay idle for more than IdleTimeout, until
+// the service is shut down.
+func (service *Service) heartbeat() {
+	interval := service.Settings.HeartbeatInterval
+	if interval <= 0 {
+		interval = service.Settings.IdleTimeout / 3
+	}
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			service.checkSessions(int64(ulid.Now()))
+		case <-service.done:
+			return
+		}
+	}
+}
+
+// checkSessions pings the sessions of the service that have been idle for
+// HeartbeatInterval and evicts those idle for IdleTimeout. Any message of a
+// client, including the answer to a ping, updates the Epoch of its session.
+func (service *Service) checkSessions(now int64) {
+	interval := int64(service.Settings.HeartbeatInterval / time.Millisecond)
+	timeout := int64(service.Settings.IdleTimeout / time.Millisecond)
+	service.Sessions.Range(func(key, value interface{}) bool {
+		session, ok := value.(*Session)
+		if !ok {
+			return true
+		}
+		idle := now - session.lastActive()
+		switch {
+		case timeout > 0 && idle >= timeout:
+			service.evict(session)
+		case interval > 0 && idle >= interval:
+			if err := session.Ping(); err != nil {
+				service.evict(session)
+			}
+		}
+		return true
+	})
+}
+
+// evict closes an idle session. The normal disconnect handling records the
+// disconnection, even if the connection is already broken.
+func (service *Service) evict(session *Session) {
+	log.Info(fmt.Sprintf("%s: Closing idle session %s", service.Name, session.SID))
+	if err := session.Close(); err != nil {
+		// The socket is already closed but the disconnect handler did not
+		// run, e.g. for a half-open connection.
+		service.removeSession(session)
+	}
+}
@@ -31,6 +31,10 @@ type LoginResponse struct {
 	Database     string      `json:"domain,omitempty"`
 	Company      int64       `json:"company,omitempty"`
 	Modules      interface{} `json:"modules,omitempty"`
+	SID          string      `json:"sid"`
+	// ResumeToken is the secret needed to resume the session, if session
+	// resumption is enabled
+	ResumeToken string `json:"resume_token,omitempty"`
 }
 
 // URL: /login
@@ -77,19 +81,7 @@ func JsonRPCLogin(s *Session, r *RequestRPC) (interface{}, error) {
 		return nil, errors.New("User not exist")
 	}
 
-	if s.ULID != "" {
-		/*
-			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
-				cnnInfo := h.JsonServiceConnection().Search(env, q.JsonServiceConnection().Session().Equals(s.SID))
-				if !cnnInfo.IsEmpty() {
-					cnnData := &h.JsonServiceConnectionData{
-						ULID: s.ULID,
-					}
-					cnnInfo.Write(cnnData, h.JsonServiceConnection().ULID())
-				}
-			})
-		*/
-	}
+	updateConnectionIdentity(s)
 
 	mods := make([]string, len(server.Modules))
 	for i, m := range server.Modules {
@@ -105,6 +97,8 @@ func JsonRPCLogin(s *Session, r *RequestRPC) (interface{}, error) {
 		Token:        token,
 		RefreshToken: refresh,
 		Modules:      mods,
+		SID:          s.SID,
+		ResumeToken:  s.issueResumeToken(),
 	}
 
 	// TODO: Log response
@@ -121,6 +115,7 @@ func JsonRPCLogin(s *Session, r *RequestRPC) (interface{}, error) {
 func JsonRPCLogout(s *Session, r *RequestRPC) (interface{}, error) {
 	s.UID = 0
 	s.ULID = ""
+	updateConnectionIdentity(s)
 	response := &server.ResponseRPC{
 		JsonRPC: r.JsonRPC,
 		ID:      r.ID,
@@ -0,0 +1,181 @@
+package websocket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/pool/h"
+)
+
+const (
+	// logBatchSize is the maximum number of messages logged at once
+	logBatchSize = 200
+	// logFlushInterval is the maximum time a message waits to be logged
+	logFlushInterval = 2 * time.Second
+	// logQueueSize is the number of messages waiting to be logged above
+	// which new messages are not logged
+	logQueueSize = 10000
+	// logDecodeFactor limits the size of the messages that are decoded for
+	// logging to this factor of the maximum content size. The content of
+	// larger messages is not logged.
+	logDecodeFactor = 16
+	// redactedValue replaces the values of redacted fields
+	redactedValue = "***"
+	// logSessionSize is the number of bytes of the hash of the SID that
+	// identify a session in the message logs
+	logSessionSize = 8
+)
+
+// DefaultRedactFields are the fields whose values are never logged
+var DefaultRedactFields = []string{
+	"password", "old_pwd", "new_password", "confirm_pwd",
+	"token", "access_token", "refresh_token", "resume_token", "key", "secret",
+}
+
+// A logEntry is a message waiting to be logged
+type logEntry struct {
+	service  *Service
+	sid      string
+	time     int64
+	codec    Codec
+	msg      []byte
+	outbound bool
+}
+
+var (
+	logWriter     *batchWriter
+	logWriterOnce sync.Once
+)
+
+// messageLogWriter returns the writer of the message logs
+func messageLogWriter() *batchWriter {
+	logWriterOnce.Do(func() {
+		logWriter = newBatchWriter(logBatchSize, logFlushInterval, writeLogs)
+	})
+	return logWriter
+}
+
+// Log queues a message received from or sent to the client of the session
+// for logging, if logging is enabled for the service. Messages are sampled
+// and written in the background.
+func (service *Service) Log(s *Session, codec Codec, msg []byte, outbound bool) {
+	config := service.Settings
+	if config == nil || !config.LogMessages {
+		return
+	}
+	if config.LogSampleRate < 1 && rand.Float64() >= config.LogSampleRate {
+		return
+	}
+	writer := messageLogWriter()
+	if writer.Len() >= logQueueSize {
+		return
+	}
+	writer.Add(&logEntry{
+		service:  service,
+		sid:      s.SID,
+		time:     int64(ulid.Now()),
+		codec:    codec,
+		msg:      msg,
+		outbound: outbound,
+	})
+}
+
+// redact replaces the values of the fields of value that are in fields
+func redact(value interface{}, fields map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if fields[strings.ToLower(k)] {
+				v[k] = redactedValue
+				continue
+			}
+			v[k] = redact(item, fields)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redact(item, fields)
+		}
+	}
+	return value
+}
+
+// logSession returns the reference of the session with the given SID in the
+// message logs: a truncated hash of the SID, which groups the messages of a
+// session without revealing its SID.
+func logSession(sid string) string {
+	sum := sha256.Sum256([]byte(sid))
+	return hex.EncodeToString(sum[:logSessionSize])
+}
+
+// epochOf returns the epoch field of the given value, if it is an object
+func epochOf(value interface{}) int64 {
+	if m, ok := value.(map[string]interface{}); ok {
+		if epoch, ok := m["epoch"].(float64); ok {
+			return int64(epoch)
+		}
+	}
+	return 0
+}
+
+// logData returns the log record of the given entry
+func (entry *logEntry) logData() *h.JsonServiceLogsData {
+	config := entry.service.Settings
+	data := &h.JsonServiceLogsData{
+		Service:  entry.service.Name,
+		Session:  logSession(entry.sid),
+		UnixTime: entry.time,
+		Outbound: entry.outbound,
+	}
+	if len(entry.msg) > config.LogMaxContentSize*logDecodeFactor {
+		data.Content = fmt.Sprintf("<%d bytes>", len(entry.msg))
+		data.Truncated = true
+		return data
+	}
+	var message map[string]interface{}
+	if err := entry.codec.Unmarshal(entry.msg, &message); err != nil {
+		data.Content = fmt.Sprintf("<%d bytes, %s>", len(entry.msg), err)
+		return data
+	}
+	data.Method, _ = message["method"].(string)
+	_, isRequest := message["params"]
+	data.Response = !isRequest
+	if !entry.outbound {
+		switch {
+		case isRequest:
+			data.PeerTime = epochOf(message["params"])
+		case message["error"] != nil:
+			data.PeerTime = epochOf(message["error"])
+		default:
+			data.PeerTime = epochOf(message["result"])
+		}
+	}
+	content, _ := json.Marshal(redact(message, entry.service.redactFields))
+	if len(content) > config.LogMaxContentSize {
+		content = content[:config.LogMaxContentSize]
+		data.Truncated = true
+	}
+	data.Content = string(content)
+	return data
+}
+
+// writeLogs writes the given log entries
+func writeLogs(items []interface{}) {
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		for _, item := range items {
+			h.JsonServiceLogs().Create(env, item.(*logEntry).logData())
+		}
+	})
+	if err != nil {
+		log.Warn("Unable to write message logs", "messages", len(items), "error", err)
+	}
+}
@@ -0,0 +1,53 @@
+package websocket
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	fields := map[string]bool{"password": true, "token": true}
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{"scalar", "password", "password"},
+		{"nil", nil, nil},
+		{"flat",
+			map[string]interface{}{"login": "admin", "password": "secret"},
+			map[string]interface{}{"login": "admin", "password": redactedValue}},
+		{"case insensitive",
+			map[string]interface{}{"Password": "secret", "TOKEN": 42.0},
+			map[string]interface{}{"Password": redactedValue, "TOKEN": redactedValue}},
+		{"nested",
+			map[string]interface{}{"params": map[string]interface{}{"args": []interface{}{
+				map[string]interface{}{"token": "abc", "name": "x"}, "token",
+			}}},
+			map[string]interface{}{"params": map[string]interface{}{"args": []interface{}{
+				map[string]interface{}{"token": redactedValue, "name": "x"}, "token",
+			}}}},
+		{"whole object",
+			map[string]interface{}{"password": map[string]interface{}{"old": "a", "new": "b"}},
+			map[string]interface{}{"password": redactedValue}},
+	}
+	for _, tt := range tests {
+		if got := redact(tt.value, fields); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: redact() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLogSession(t *testing.T) {
+	sid := NewULID()
+	ref := logSession(sid)
+	if len(ref) != 2*logSessionSize {
+		t.Errorf("logSession(%q) = %q, want %d characters", sid, ref, 2*logSessionSize)
+	}
+	if ref != logSession(sid) {
+		t.Error("logSession is not stable")
+	}
+	if ref == logSession(NewULID()) {
+		t.Error("logSession is the same for different sessions")
+	}
+}
@@ -2,7 +2,7 @@ package websocket
 
 import (
 	//"encoding/json"
-	"errors"
+	//"errors"
 	//"fmt"
 	//"net/http"
 
@@ -19,7 +19,7 @@ import (
 func JsonRPCMenuLoadNeedaction(s *Session, r *RequestRPC) (interface{}, error) {
 	uid := s.UID
 	if uid == 0 {
-		return nil, errors.New("Access denied")
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
 	}
 	response := &server.ResponseRPC{
 		JsonRPC: r.JsonRPC,
@@ -0,0 +1,402 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/oklog/ulid"
+	"github.com/olahol/melody"
+	"github.com/spf13/viper"
+)
+
+const (
+	// DefaultMQTTPrefix is the default root of the device topics
+	DefaultMQTTPrefix = "devices"
+	// mqttInboxSize is the number of messages of a device waiting to be
+	// handled. Messages received when it is full are dropped.
+	mqttInboxSize = 64
+)
+
+// MQTTConfig holds the settings of the MQTT bridge. The bridge connects to a
+// local broker and maps the device topics to the methods of a service. The
+// bridge speaks MQTT 3.1.1 only, the sole version supported by paho v1.2.0;
+// devices must use a broker that accepts MQTT 3.1.1 clients.
+//
+// The device topics are:
+//
+//	<prefix>/<ulid>/rpc/<method>   requests of the device to the given method.
+//	                               The payload is a JSON-RPC request or its params.
+//	<prefix>/<ulid>/rpc            JSON-RPC requests and responses of the device
+//	<prefix>/<ulid>/binary         binary frames of the device (uploads)
+//	<prefix>/<ulid>/status         "offline" closes the session of the device,
+//	                               e.g. as its last will
+//	<prefix>/<ulid>/cmd            responses and server pushes to the device
+//	<prefix>/<ulid>/cmd/binary     binary frames to the device (downloads)
+//
+// Devices authenticate by calling device_login with their usual credentials.
+// MQTT 3.1.1 messages do not carry the identity of their publisher, so the
+// bridge identifies a device by its topic: the broker must restrict each
+// device client to the topics of its own ULID, e.g. with the mosquitto ACL
+//
+//	pattern readwrite devices/%c/#
+//
+// for devices connecting with their ULID as client ID, while the client of
+// the bridge may use all the device topics. The bridge does not start
+// unless DeviceACL is set to confirm that the broker enforces it.
+type MQTTConfig struct {
+	// Broker is the URL of the broker, e.g. tcp://localhost:1883. The bridge
+	// is disabled if it is empty.
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// Service is the name of the service whose methods are called
+	Service string
+	// Prefix is the root of the device topics
+	Prefix string
+	// QoS is the quality of service of the subscriptions and publications
+	QoS byte
+	// DeviceACL confirms that the broker restricts each device to its own
+	// topics. It is required to start the bridge.
+	DeviceACL bool
+}
+
+// LoadMQTTConfig returns the settings of the MQTT bridge read from the
+// "Websocket.MQTT" section of the Hexya configuration.
+func LoadMQTTConfig() *MQTTConfig {
+	config := &MQTTConfig{
+		ClientID: "hexya-websocket",
+		Service:  "jsonrpc",
+		Prefix:   DefaultMQTTPrefix,
+		QoS:      1,
+	}
+	prefix := "Websocket.MQTT."
+	if viper.IsSet(prefix + "Broker") {
+		config.Broker = viper.GetString(prefix + "Broker")
+	}
+	if viper.IsSet(prefix + "ClientID") {
+		config.ClientID = viper.GetString(prefix + "ClientID")
+	}
+	if viper.IsSet(prefix + "Username") {
+		config.Username = viper.GetString(prefix + "Username")
+	}
+	if viper.IsSet(prefix + "Password") {
+		config.Password = viper.GetString(prefix + "Password")
+	}
+	if viper.IsSet(prefix + "Service") {
+		config.Service = viper.GetString(prefix + "Service")
+	}
+	if viper.IsSet(prefix + "Prefix") {
+		config.Prefix = strings.Trim(viper.GetString(prefix+"Prefix"), "/")
+	}
+	if viper.IsSet(prefix + "QoS") {
+		config.QoS = byte(viper.GetInt(prefix + "QoS"))
+	}
+	if viper.IsSet(prefix + "DeviceACL") {
+		config.DeviceACL = viper.GetBool(prefix + "DeviceACL")
+	}
+	return config
+}
+
+// An mqttMessage is a message received from a device
+type mqttMessage struct {
+	kind    string
+	method  string
+	payload []byte
+}
+
+// An mqttBridge connects devices speaking MQTT to a service
+type mqttBridge struct {
+	config   *MQTTConfig
+	service  *Service
+	client   mqtt.Client
+	sessions sync.Map
+	done     chan struct{}
+}
+
+// An mqttSession is the Transport of the session of a device connected
+// through the MQTT bridge. Its messages are handled in order by a goroutine.
+type mqttSession struct {
+	bridge    *mqttBridge
+	session   *Session
+	ulid      string
+	inbox     chan *mqttMessage
+	closeOnce sync.Once
+}
+
+// bridge is the running MQTT bridge, if any
+var bridge *mqttBridge
+
+// topic returns the topic of the given device with the given suffix
+func (b *mqttBridge) topic(deviceULID, suffix string) string {
+	return fmt.Sprintf("%s/%s/%s", b.config.Prefix, deviceULID, suffix)
+}
+
+// publish publishes payload on the given topic and waits for the broker
+func (b *mqttBridge) publish(topic string, payload []byte) error {
+	token := b.client.Publish(topic, b.config.QoS, false, payload)
+	if !token.WaitTimeout(b.service.Settings.WriteWait) {
+		return errors.New("MQTT publish timeout on " + topic)
+	}
+	return token.Error()
+}
+
+// Write publishes a text message to the device
+func (ms *mqttSession) Write(msg []byte) error {
+	return ms.bridge.publish(ms.bridge.topic(ms.ulid, "cmd"), msg)
+}
+
+// WriteBinary publishes a binary message to the device
+func (ms *mqttSession) WriteBinary(msg []byte) error {
+	return ms.bridge.publish(ms.bridge.topic(ms.ulid, "cmd/binary"), msg)
+}
+
+// Close ends the session of the device. The device must log in again to
+// send requests.
+func (ms *mqttSession) Close() error {
+	ms.closeOnce.Do(func() {
+		if current, ok := ms.bridge.sessions.Load(ms.ulid); ok && current == ms {
+			ms.bridge.sessions.Delete(ms.ulid)
+		}
+		close(ms.inbox)
+		ms.bridge.service.removeSession(ms.session)
+		log.Info(fmt.Sprintf("%s: MQTT device %s disconnected (sessionid: %s)",
+			ms.bridge.service.Name, ms.ulid, ms.session.SID))
+	})
+	return nil
+}
+
+// run handles the messages of the device until the session is closed
+func (ms *mqttSession) run() {
+	service := ms.bridge.service
+	for msg := range ms.inbox {
+		if !service.beginHandler() {
+			continue
+		}
+		ms.session.touch()
+		switch msg.kind {
+		case "binary":
+			for _, fn := range service.mwb {
+				fn(ms.session, msg.payload)
+			}
+			service.HandleBinary(ms.session, msg.payload)
+		default:
+			for _, fn := range service.mw {
+				fn(ms.session, msg.payload)
+			}
+			service.handleMessage(ms.session, defaultCodec, msg.payload)
+		}
+		service.endHandler()
+	}
+}
+
+// newSession creates the session of the device with the given ULID
+func (b *mqttBridge) newSession(deviceULID string) *mqttSession {
+	ms := &mqttSession{
+		bridge: b,
+		ulid:   deviceULID,
+		inbox:  make(chan *mqttMessage, mqttInboxSize),
+	}
+	request := &http.Request{
+		Method:     "MQTT",
+		URL:        &url.URL{Scheme: "mqtt", Path: b.topic(deviceULID, "")},
+		Header:     make(http.Header),
+		RemoteAddr: b.config.Broker,
+	}
+	ms.session = &Session{
+		Session:   &melody.Session{Request: request},
+		Service:   b.service,
+		Epoch:     int64(ulid.Now()),
+		SID:       NewULID(),
+		transport: ms,
+	}
+	if previous, loaded := b.sessions.LoadOrStore(deviceULID, ms); loaded {
+		return previous.(*mqttSession)
+	}
+	b.service.addSession(ms.session)
+	go ms.run()
+	log.Info(fmt.Sprintf("%s: MQTT device %s connected (sessionid: %s)", b.service.Name, deviceULID, ms.session.SID))
+	return ms
+}
+
+// reject sends an error response for the given request to a device that
+// has no session.
+func (b *mqttBridge) reject(deviceULID string, request *RequestRPC, code ErrorCode, message string) {
+	data, err := json.Marshal(NewResponseError(request, code, message, nil))
+	if err == nil {
+		err = b.publish(b.topic(deviceULID, "cmd"), data)
+	}
+	if err != nil {
+		log.Info("Unable to send MQTT response", "device", deviceULID, "error", err)
+	}
+}
+
+// rpcRequest returns the JSON-RPC request for the given payload received on
+// the topic of the given method. The payload is either a JSON-RPC request or
+// the params of a notification.
+func rpcRequest(method string, payload []byte) (*RequestRPC, error) {
+	var request RequestRPC
+	if err := json.Unmarshal(payload, &request); err != nil || request.JsonRPC == "" {
+		if !json.Valid(payload) {
+			return nil, errors.New("Invalid JSON payload")
+		}
+		params := json.RawMessage(payload)
+		request = RequestRPC{JsonRPC: "2.0", Params: &params}
+	}
+	if method != "" {
+		request.Method = method
+		if request.Params == nil {
+			params := json.RawMessage("{}")
+			request.Params = &params
+		}
+	}
+	return &request, nil
+}
+
+// handle routes a message received from the broker to the session of the
+// device. Only device_login may be called by a device without a session.
+// The device is identified by the topic of the message, which the broker
+// ACL binds to the device client (see MQTTConfig).
+func (b *mqttBridge) handle(client mqtt.Client, message mqtt.Message) {
+	parts := strings.Split(strings.TrimPrefix(message.Topic(), b.config.Prefix+"/"), "/")
+	if len(parts) < 2 || b.service.Closing() {
+		return
+	}
+	deviceULID := parts[0]
+	msg := &mqttMessage{kind: parts[1], payload: message.Payload()}
+	value, exists := b.sessions.Load(deviceULID)
+	switch msg.kind {
+	case "status":
+		if exists && string(msg.payload) == "offline" {
+			value.(*mqttSession).Close()
+		}
+		return
+	case "binary":
+		if !exists {
+			return
+		}
+	case "rpc":
+		if len(parts) > 2 {
+			msg.method = parts[2]
+		}
+		request, err := rpcRequest(msg.method, msg.payload)
+		if err != nil {
+			b.reject(deviceULID, &RequestRPC{JsonRPC: "2.0"}, ErrorCodeParse, err.Error())
+			return
+		}
+		if request.Method == "device_login" {
+			var login DeviceLogin
+			if request.Params == nil || json.Unmarshal(*request.Params, &login) != nil {
+				b.reject(deviceULID, request, ErrorCodeInvalidParams, "Invalid device_login parameters")
+				return
+			}
+			if login.Ulid != deviceULID {
+				b.reject(deviceULID, request, ErrorCodeAccessDenied, ErrInvalidCredentials.Error())
+				return
+			}
+		} else if !exists || value.(*mqttSession).session.DeviceID == 0 {
+			if request.Params != nil {
+				b.reject(deviceULID, request, ErrorCodeAccessDenied, "Access denied")
+			}
+			return
+		}
+		if msg.payload, err = json.Marshal(request); err != nil {
+			return
+		}
+	default:
+		return
+	}
+	ms := b.newSession(deviceULID)
+	defer func() {
+		// The session may be closed while the message is queued
+		if r := recover(); r != nil {
+			log.Info("MQTT message dropped", "device", deviceULID, "error", r)
+		}
+	}()
+	select {
+	case ms.inbox <- msg:
+	default:
+		log.Warn("MQTT inbox full, message dropped", "device", deviceULID)
+	}
+}
+
+// subscribe subscribes the bridge to the device topics
+func (b *mqttBridge) subscribe(client mqtt.Client) {
+	for _, suffix := range []string{"rpc", "rpc/+", "binary", "status"} {
+		token := client.Subscribe(b.topic("+", suffix), b.config.QoS, b.handle)
+		if token.WaitTimeout(b.service.Settings.WriteWait) && token.Error() != nil {
+			log.Warn("MQTT subscription failed", "topic", b.topic("+", suffix), "error", token.Error())
+		}
+	}
+}
+
+// stop closes the sessions of the devices and disconnects the bridge from
+// the broker
+func (b *mqttBridge) stop() {
+	close(b.done)
+	b.sessions.Range(func(key, value interface{}) bool {
+		value.(*mqttSession).Close()
+		return true
+	})
+	if b.client.IsConnected() {
+		b.client.Disconnect(uint(b.service.Settings.WriteWait / time.Millisecond))
+	}
+	log.Info("MQTT bridge stopped", "broker", b.config.Broker, "service", b.service.Name)
+}
+
+// startMQTT starts the MQTT bridge if a broker is configured
+func startMQTT() {
+	config := LoadMQTTConfig()
+	if config.Broker == "" {
+		return
+	}
+	if !config.DeviceACL {
+		log.Warn("MQTT bridge not started: the broker must restrict each device to its own topics, "+
+			"set Websocket.MQTT.DeviceACL once it does", "broker", config.Broker)
+		return
+	}
+	service, err := GetService(config.Service)
+	if err != nil {
+		log.Warn("MQTT bridge not started", "service", config.Service, "error", err)
+		return
+	}
+	b := &mqttBridge{config: config, service: service, done: make(chan struct{})}
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetProtocolVersion(4).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetConnectTimeout(10 * time.Second).
+		SetOnConnectHandler(b.subscribe).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			log.Warn("MQTT connection lost", "broker", config.Broker, "error", err)
+		})
+	b.client = mqtt.NewClient(options)
+	go func() {
+		// Retry until the broker is reachable. Auto reconnection takes
+		// over once the first connection is made.
+		for {
+			token := b.client.Connect()
+			if token.Wait() && token.Error() == nil {
+				log.Info("MQTT bridge connected", "broker", config.Broker, "service", config.Service)
+				return
+			}
+			log.Warn("MQTT connection failed", "broker", config.Broker, "error", token.Error())
+			select {
+			case <-time.After(10 * time.Second):
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	bridge = b
+}
@@ -0,0 +1,115 @@
+package websocket
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// A testMQTTToken is a completed MQTT token
+type testMQTTToken struct {
+	mqtt.Token
+}
+
+func (testMQTTToken) Wait() bool                     { return true }
+func (testMQTTToken) WaitTimeout(time.Duration) bool { return true }
+func (testMQTTToken) Error() error                   { return nil }
+
+// A testMQTTClient records the messages published by the bridge
+type testMQTTClient struct {
+	mqtt.Client
+	mutex     sync.Mutex
+	published map[string][][]byte
+}
+
+func (c *testMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.published == nil {
+		c.published = make(map[string][][]byte)
+	}
+	c.published[topic] = append(c.published[topic], payload.([]byte))
+	return testMQTTToken{}
+}
+
+// A testMQTTMessage is a message received from a device
+type testMQTTMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m testMQTTMessage) Topic() string   { return m.topic }
+func (m testMQTTMessage) Payload() []byte { return m.payload }
+
+func TestRPCRequest(t *testing.T) {
+	tests := []struct {
+		method     string
+		payload    string
+		wantMethod string
+		wantParams string
+		wantErr    bool
+	}{
+		{"", `{"jsonrpc":"2.0","method":"device_login","id":1}`, "device_login", "", false},
+		{"device_login", `{"jsonrpc":"2.0","id":1}`, "device_login", `{}`, false},
+		{"telemetry", `{"readings":[]}`, "telemetry", `{"readings":[]}`, false},
+		{"", `{"jsonrpc":"2.0","method":"ping","params":{"epoch":1},"id":2}`, "ping", `{"epoch":1}`, false},
+		{"telemetry", `not json`, "", "", true},
+	}
+	for _, tt := range tests {
+		request, err := rpcRequest(tt.method, []byte(tt.payload))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("rpcRequest(%q, %s) error = %v, want error %v", tt.method, tt.payload, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var params string
+		if request.Params != nil {
+			params = string(*request.Params)
+		}
+		if request.Method != tt.wantMethod || params != tt.wantParams {
+			t.Errorf("rpcRequest(%q, %s) = %s %s, want %s %s",
+				tt.method, tt.payload, request.Method, params, tt.wantMethod, tt.wantParams)
+		}
+	}
+}
+
+func TestHandleDeviceLoginWithoutParams(t *testing.T) {
+	client := new(testMQTTClient)
+	b := &mqttBridge{
+		config:  &MQTTConfig{Prefix: DefaultMQTTPrefix},
+		service: &Service{Name: "test", Settings: &ServiceConfig{WriteWait: time.Second}},
+		client:  client,
+	}
+	deviceULID := NewULID()
+	for _, msg := range []testMQTTMessage{
+		{topic: b.topic(deviceULID, "rpc"), payload: []byte(`{"jsonrpc":"2.0","method":"device_login","id":1}`)},
+		{topic: b.topic(deviceULID, "rpc/device_login"), payload: []byte(`[1, 2]`)},
+	} {
+		b.handle(client, msg)
+	}
+
+	responses := client.published[b.topic(deviceULID, "cmd")]
+	if len(responses) != 2 {
+		t.Fatalf("%d responses published, want 2", len(responses))
+	}
+	for _, data := range responses {
+		var response struct {
+			Error JSONRPCError `json:"error"`
+		}
+		if err := json.Unmarshal(data, &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Error.Code != int(ErrorCodeInvalidParams) {
+			t.Errorf("response %s, want error code %d", data, ErrorCodeInvalidParams)
+		}
+	}
+	if _, ok := b.sessions.Load(deviceULID); ok {
+		t.Error("session created for an invalid login")
+	}
+}
@@ -0,0 +1,205 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/hexya-erp/hexya/src/server"
+)
+
+// A NotificationRPC is a message sent to a client without expecting an answer
+type NotificationRPC struct {
+	JsonRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+// TopicParams is the format of the parameters of subscribe and unsubscribe
+type TopicParams struct {
+	Topics []string `json:"topics"`
+}
+
+// A TopicAuthorizer returns true if the session may subscribe to topic
+type TopicAuthorizer func(s *Session, topic string) bool
+
+// topicAuthorizers are the authorizers of the topics, by prefix
+var topicAuthorizers = make(map[string]TopicAuthorizer)
+
+// RegisterTopic registers the authorizer of the topic named prefix and of
+// the topics starting with prefix followed by a dot. Clients cannot
+// subscribe to topics without authorizer.
+//
+// RegisterTopic must be called in init functions: the registry is not
+// protected against concurrent accesses.
+func RegisterTopic(prefix string, authorizer TopicAuthorizer) {
+	topicAuthorizers[prefix] = authorizer
+}
+
+// canSubscribe returns true if the authorizer of topic allows the session
+// to subscribe to it
+func canSubscribe(s *Session, topic string) bool {
+	prefix := topic
+	if i := strings.Index(topic, "."); i >= 0 {
+		prefix = topic[:i]
+	}
+	authorizer, ok := topicAuthorizers[prefix]
+	return ok && authorizer(s, topic)
+}
+
+// authorizeRecordTopic allows users to subscribe to the changes of the
+// records they can read, or of all the records of a model if they have the
+// read access right on it.
+func authorizeRecordTopic(s *Session, topic string) bool {
+	model, id, ok := parseRecordTopic(topic)
+	switch {
+	case !ok || s.UID == 0:
+		return false
+	case id == 0:
+		return canReadModel(s.UID, model)
+	}
+	return canReadRecord(s.UID, model, id)
+}
+
+// Subscribe adds the given topics to the subscriptions of the session
+func (s *Session) Subscribe(topics ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.topics == nil {
+		s.topics = make(map[string]bool)
+	}
+	for _, topic := range topics {
+		s.topics[topic] = true
+	}
+}
+
+// Unsubscribe removes the given topics from the subscriptions of the session
+func (s *Session) Unsubscribe(topics ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, topic := range topics {
+		delete(s.topics, topic)
+	}
+}
+
+// Subscribed returns true if the session is subscribed to topic
+func (s *Session) Subscribed(topic string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.topics[topic]
+}
+
+// Topics returns the list of topics the session is subscribed to
+func (s *Session) Topics() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res := make([]string, 0, len(s.topics))
+	for topic := range s.topics {
+		res = append(res, topic)
+	}
+	return res
+}
+
+// Notify sends a notification with the given method and params to the session
+func (s *Session) Notify(method string, params interface{}) error {
+	return s.Send(&NotificationRPC{
+		JsonRPC: "2.0",
+		Method:  method,
+		Params:  params,
+	})
+}
+
+// Publish sends a notification with the given method and params to all
+// the sessions of the service that are subscribed to one of the topics, on
+// all the server instances. The notifications of detached sessions are
+// buffered until they are resumed.
+func (service *Service) Publish(method string, params interface{}, topics ...string) {
+	publish(service.Name, method, params, topics)
+}
+
+// PublishAll publishes the given notification to the subscribers of the
+// topics on all the registered services.
+func PublishAll(method string, params interface{}, topics ...string) {
+	publish("", method, params, topics)
+}
+
+// publish broadcasts a notification to the subscribers of the topics on the
+// given service, or on all services if it is empty
+func publish(service, method string, params interface{}, topics []string) {
+	msg, err := newStoreMessage(StorePublish, method, params)
+	if err != nil {
+		log.Info("Unable to encode notification", "method", method, "error", err)
+		return
+	}
+	msg.Service = service
+	msg.Topics = topics
+	broadcast(msg)
+}
+
+// publish notifies the session if it is subscribed to one of the topics
+func (s *Session) publish(method string, params interface{}, topics []string) {
+	for _, topic := range topics {
+		if s.Subscribed(topic) {
+			if err := s.Notify(method, params); err != nil {
+				log.Info("Unable to send notification", "method", method, "session", s.SID, "error", err)
+			}
+			return
+		}
+	}
+}
+
+// JsonRPCSubscribe subscribes the session of a user or a device to the
+// given topics. If the session may not subscribe to one of them, no
+// subscription is made and the error data lists the refused topics.
+func JsonRPCSubscribe(s *Session, r *RequestRPC) (interface{}, error) {
+	if s.UID == 0 && s.DeviceID == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
+	}
+	if r.Params == nil {
+		return NewResponseError(r, ErrorCodeInvalidParams, "JsonRPCSubscribe error: Missing topics", nil), nil
+	}
+	var params TopicParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return nil, errors.New("JsonRPCSubscribe error: Invalid format")
+	}
+	refused := make([]string, 0)
+	for _, topic := range params.Topics {
+		if !canSubscribe(s, topic) {
+			refused = append(refused, topic)
+		}
+	}
+	if len(refused) > 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, "Access denied", &TopicParams{Topics: refused}), nil
+	}
+	s.Subscribe(params.Topics...)
+	response := &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  s.Topics(),
+	}
+	return response, nil
+}
+
+// JsonRPCUnsubscribe unsubscribes the session from the given topics
+func JsonRPCUnsubscribe(s *Session, r *RequestRPC) (interface{}, error) {
+	if r.Params == nil {
+		return NewResponseError(r, ErrorCodeInvalidParams, "JsonRPCUnsubscribe error: Missing topics", nil), nil
+	}
+	var params TopicParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return nil, errors.New("JsonRPCUnsubscribe error: Invalid format")
+	}
+	s.Unsubscribe(params.Topics...)
+	response := &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  s.Topics(),
+	}
+	return response, nil
+}
+
+func init() {
+	RegisterTopic("record", authorizeRecordTopic)
+}
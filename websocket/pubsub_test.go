@@ -0,0 +1,69 @@
+package websocket
+
+import "testing"
+
+func TestParseRecordTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		model string
+		id    int64
+		ok    bool
+	}{
+		{"record.Partner", "Partner", 0, true},
+		{"record.Partner.12", "Partner", 12, true},
+		{"record", "", 0, false},
+		{"record.", "", 0, false},
+		{"record.Partner.0", "", 0, false},
+		{"record.Partner.-3", "", 0, false},
+		{"record.Partner.abc", "", 0, false},
+		{"record.Partner.1.2", "", 0, false},
+		{"shadow.Partner", "", 0, false},
+	}
+	for _, tt := range tests {
+		model, id, ok := parseRecordTopic(tt.topic)
+		if model != tt.model || id != tt.id || ok != tt.ok {
+			t.Errorf("parseRecordTopic(%q) = %q, %d, %v, want %q, %d, %v",
+				tt.topic, model, id, ok, tt.model, tt.id, tt.ok)
+		}
+	}
+}
+
+func TestCanSubscribe(t *testing.T) {
+	saved := topicAuthorizers
+	defer func() { topicAuthorizers = saved }()
+	topicAuthorizers = make(map[string]TopicAuthorizer)
+	RegisterTopic("open", func(s *Session, topic string) bool { return true })
+	RegisterTopic("owner", func(s *Session, topic string) bool { return topic == "owner.1" && s.UID == 1 })
+
+	tests := []struct {
+		name  string
+		uid   int64
+		topic string
+		want  bool
+	}{
+		{"open topic", 2, "open", true},
+		{"open sub topic", 2, "open.anything", true},
+		{"owner allowed", 1, "owner.1", true},
+		{"owner other user", 2, "owner.1", false},
+		{"owner other topic", 1, "owner.2", false},
+		{"unknown topic", 1, "unknown", false},
+		{"unknown sub topic", 1, "unknown.open", false},
+		{"prefix is not a segment", 1, "opened", false},
+		{"record without authorizer", 1, "record.Partner", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canSubscribe(&Session{UID: tt.uid}, tt.topic); got != tt.want {
+				t.Errorf("canSubscribe(%q) = %v, want %v", tt.topic, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeRecordTopicAnonymous(t *testing.T) {
+	for _, topic := range []string{"record.Partner", "record.Partner.1", "record.Partner.x"} {
+		if authorizeRecordTopic(&Session{}, topic) {
+			t.Errorf("authorizeRecordTopic(%q) allowed an anonymous session", topic)
+		}
+	}
+}
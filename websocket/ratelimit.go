@@ -0,0 +1,445 @@
+package websocket
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/pool/h"
+)
+
+const (
+	// ErrorCodeRateLimited is the error code of the requests refused
+	// because the client exceeded a rate limit
+	ErrorCodeRateLimited ErrorCode = -32029
+	// RateLimitAll is the method of the limits that apply to all the
+	// requests to a service together
+	RateLimitAll = "*"
+	// rateLimitStatsInterval is the period of the writes of the rate limit
+	// statistics, of the sweeps of the token buckets and of the expiry of
+	// the detached sessions
+	rateLimitStatsInterval = 10 * time.Second
+)
+
+// Scopes of the rate limits
+const (
+	RateLimitSession = "session"
+	RateLimitUser    = "user"
+	RateLimitIP      = "ip"
+)
+
+// A RateLimit is a token bucket limit. Rate is the number of requests
+// allowed per second on average and Burst the number of requests allowed
+// at once. There is no limit if either is 0.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// enabled returns true if the limit is set
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// MethodLimits are the limits of a method for each session, each user and
+// each remote IP address
+type MethodLimits struct {
+	Session RateLimit
+	User    RateLimit
+	IP      RateLimit
+}
+
+// DefaultRateLimits returns the default rate limits of services, by method
+func DefaultRateLimits() map[string]MethodLimits {
+	return map[string]MethodLimits{
+		RateLimitAll:   {Session: RateLimit{Rate: 50, Burst: 200}},
+		"login":        {IP: RateLimit{Rate: 0.2, Burst: 10}},
+		"device_login": {IP: RateLimit{Rate: 1, Burst: 50}},
+		"call_kw":      {User: RateLimit{Rate: 20, Burst: 100}},
+	}
+}
+
+// RateLimitedData is the data of the error of a rate limited request
+type RateLimitedData struct {
+	Method string `json:"method"`
+	Scope  string `json:"scope"`
+	// RetryAfter is the time in milliseconds after which the request
+	// would be accepted
+	RetryAfter int64 `json:"retry_after"`
+}
+
+// A tokenBucket holds the tokens of a rate limit, refilled over time
+type tokenBucket struct {
+	tokens float64
+	date   time.Time
+	full   time.Duration
+}
+
+// refill adds the tokens earned since the last refill to the bucket
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	if b.date.IsZero() {
+		b.tokens = float64(limit.Burst)
+	} else if now.After(b.date) {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.date).Seconds()*limit.Rate)
+	}
+	if now.After(b.date) {
+		b.date = now
+	}
+	b.full = time.Duration(float64(limit.Burst) / limit.Rate * float64(time.Second))
+}
+
+// wait returns 0 if the bucket has a token or the time until it has one
+func (b *tokenBucket) wait(limit RateLimit, now time.Time) time.Duration {
+	b.refill(limit, now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// take takes a token from the bucket. It returns 0 if a token was
+// available or the time until one is.
+func (b *tokenBucket) take(limit RateLimit, now time.Time) time.Duration {
+	if wait := b.wait(limit, now); wait > 0 {
+		return wait
+	}
+	b.tokens--
+	return 0
+}
+
+// A bucketKey identifies the bucket of a method for a session, user or IP
+type bucketKey struct {
+	method string
+	scope  string
+	key    string
+}
+
+// A rateLimiter holds the token buckets of a service
+type rateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[bucketKey]*tokenBucket
+}
+
+// A bucketLimit is the limit of the bucket of a key
+type bucketLimit struct {
+	key   bucketKey
+	limit RateLimit
+}
+
+// takeAll takes a token from each of the given buckets if all of them have
+// one. Otherwise no token is taken and it returns the index of the bucket
+// with the longest wait and the time until it has a token. It returns -1
+// if the tokens were taken.
+func (rl *rateLimiter) takeAll(limits []bucketLimit, now time.Time) (int, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.buckets == nil {
+		rl.buckets = make(map[bucketKey]*tokenBucket)
+	}
+	buckets := make([]*tokenBucket, len(limits))
+	exceeded, wait := -1, time.Duration(0)
+	for i, l := range limits {
+		bucket, ok := rl.buckets[l.key]
+		if !ok {
+			bucket = new(tokenBucket)
+			rl.buckets[l.key] = bucket
+		}
+		buckets[i] = bucket
+		if w := bucket.wait(l.limit, now); w > wait {
+			exceeded, wait = i, w
+		}
+	}
+	if exceeded >= 0 {
+		return exceeded, wait
+	}
+	for i, bucket := range buckets {
+		bucket.take(limits[i].limit, now)
+	}
+	return -1, 0
+}
+
+// sweep forgets the buckets that have been refilled, which are the same as
+// new buckets
+func (rl *rateLimiter) sweep(now time.Time) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.date) > bucket.full {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// parseTrustedProxies returns the networks of the given addresses or CIDR
+// networks. Invalid entries are ignored.
+func parseTrustedProxies(entries []string) []*net.IPNet {
+	var res []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				log.Warn("Invalid trusted proxy", "proxy", entry)
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Warn("Invalid trusted proxy", "proxy", entry, "error", err)
+			continue
+		}
+		res = append(res, network)
+	}
+	return res
+}
+
+// trustedProxy returns true if the given address is a trusted proxy
+func (service *Service) trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range service.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddress returns the IP address of the client of the session. When
+// the connection comes from a trusted proxy, it is the last address of the
+// X-Forwarded-For header that is not a trusted proxy, since the addresses
+// before it may be forged by the client.
+func (service *Service) clientAddress(s *Session) string {
+	address, _ := peerAddress(s)
+	if !service.trustedProxy(address) {
+		return address
+	}
+	var forwarded []string
+	for _, header := range s.Request.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				forwarded = append(forwarded, hop)
+			}
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address = forwarded[i]
+		if !service.trustedProxy(address) {
+			break
+		}
+	}
+	return address
+}
+
+// checkRateLimits checks the buckets of the session, user and IP address
+// for the given method and for all the methods, then takes a token from
+// each of them if none is empty. It returns the scope of the exceeded limit
+// and the time until the request would be accepted, or an empty scope if
+// the request is accepted.
+func (service *Service) checkRateLimits(s *Session, method string, now time.Time) (string, time.Duration) {
+	keys := map[string]string{
+		RateLimitSession: s.SID,
+	}
+	// The sessions of the MQTT bridge all have the address of the broker
+	if s.transport == nil {
+		keys[RateLimitIP] = service.clientAddress(s)
+	}
+	if s.UID != 0 {
+		keys[RateLimitUser] = strconv.FormatInt(s.UID, 10)
+	}
+	methods := []string{method, RateLimitAll}
+	if method == RateLimitAll {
+		methods = methods[:1]
+	}
+	var buckets []bucketLimit
+	for _, m := range methods {
+		limits, ok := service.Settings.RateLimits[m]
+		if !ok {
+			continue
+		}
+		for _, l := range []struct {
+			scope string
+			limit RateLimit
+		}{
+			{RateLimitSession, limits.Session},
+			{RateLimitUser, limits.User},
+			{RateLimitIP, limits.IP},
+		} {
+			key, ok := keys[l.scope]
+			if !ok || key == "" || !l.limit.enabled() {
+				continue
+			}
+			buckets = append(buckets, bucketLimit{key: bucketKey{method: m, scope: l.scope, key: key}, limit: l.limit})
+		}
+	}
+	exceeded, wait := service.limiter.takeAll(buckets, now)
+	if exceeded < 0 {
+		return "", 0
+	}
+	return buckets[exceeded].key.scope, wait
+}
+
+// rateLimit returns the error answering the given request if it exceeds a
+// rate limit, or nil if it is accepted. Sessions exceeding limits too often
+// are closed.
+func (service *Service) rateLimit(s *Session, r *RequestRPC) *ResponseError {
+	now := time.Now()
+	scope, wait := service.checkRateLimits(s, r.Method, now)
+	if scope == "" {
+		return nil
+	}
+	disconnect := s.rateLimited(now)
+	// Unknown methods are counted together so that clients cannot add
+	// statistics rows at will
+	method := r.Method
+	if _, ok := service.methods[method]; !ok {
+		method = RateLimitAll
+	}
+	countRateLimit(service.Name, method, scope, disconnect)
+	if disconnect {
+		log.Warn(fmt.Sprintf("%s: Closing session %s exceeding rate limits", service.Name, s.SID),
+			"method", r.Method, "scope", scope)
+		go s.Close()
+	}
+	return NewResponseError(r, ErrorCodeRateLimited, "Too many requests", &RateLimitedData{
+		Method:     r.Method,
+		Scope:      scope,
+		RetryAfter: int64(math.Ceil(float64(wait) / float64(time.Millisecond))),
+	})
+}
+
+// rateLimited records a rate limited request of the session. It returns
+// true if the session exceeded RateLimitMaxViolations limits within
+// RateLimitViolationWindow and must be closed.
+func (s *Session) rateLimited(now time.Time) bool {
+	config := s.Service.Settings
+	if config.RateLimitMaxViolations <= 0 {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if now.Sub(s.violationDate) > config.RateLimitViolationWindow {
+		s.violationDate = now
+		s.violations = 0
+	}
+	s.violations++
+	return s.violations >= config.RateLimitMaxViolations
+}
+
+// A rateLimitStat identifies the counts of rate limited requests
+type rateLimitStat struct {
+	service string
+	method  string
+	scope   string
+}
+
+// rateLimitCount are the counts of rate limited requests and of the
+// sessions closed for exceeding limits
+type rateLimitCount struct {
+	hits           int64
+	disconnections int64
+}
+
+var (
+	rateLimitStats      = make(map[rateLimitStat]*rateLimitCount)
+	rateLimitStatsMutex sync.Mutex
+)
+
+// countRateLimit counts a rate limited request
+func countRateLimit(service, method, scope string, disconnect bool) {
+	rateLimitStatsMutex.Lock()
+	defer rateLimitStatsMutex.Unlock()
+	key := rateLimitStat{service: service, method: method, scope: scope}
+	count, ok := rateLimitStats[key]
+	if !ok {
+		count = new(rateLimitCount)
+		rateLimitStats[key] = count
+	}
+	count.hits++
+	if disconnect {
+		count.disconnections++
+	}
+}
+
+// writeRateLimitStats adds the counts of rate limited requests since the
+// last call to the counts of the day in JsonServiceRateLimits
+func writeRateLimitStats(now time.Time) {
+	rateLimitStatsMutex.Lock()
+	stats := rateLimitStats
+	rateLimitStats = make(map[rateLimitStat]*rateLimitCount)
+	rateLimitStatsMutex.Unlock()
+	if len(stats) == 0 {
+		return
+	}
+	day := now.UTC().Format("2006-01-02")
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		table := h.JsonServiceRateLimits().TableName()
+		for key, count := range stats {
+			env.Cr().Execute(fmt.Sprintf(`INSERT INTO %s (service, method, scope, day, hits, disconnections,
+				create_date, write_date, hexya_external_id, hexya_version)
+				VALUES (?, ?, ?, ?::date, ?, ?, now(), now(), md5(random()::text || clock_timestamp()::text), 0)
+				ON CONFLICT (service, method, scope, day)
+				DO UPDATE SET hits = %s.hits + EXCLUDED.hits,
+					disconnections = %s.disconnections + EXCLUDED.disconnections, write_date = now()`,
+				table, table, table),
+				key.service, key.method, key.scope, day, count.hits, count.disconnections)
+		}
+	})
+	if err != nil {
+		log.Warn("Unable to write rate limit statistics", "error", err)
+	}
+}
+
+// sweepServices forgets the refilled token buckets and the expired detached
+// sessions of all the services
+func sweepServices(now time.Time) {
+	Services.Range(func(key, value interface{}) bool {
+		service := value.(*Service)
+		service.limiter.sweep(now)
+		service.expireDetachedSessions(now)
+		return true
+	})
+}
+
+// startRateLimitStats starts the periodic writes of the rate limit
+// statistics and sweeps of the services, which run whatever the heartbeat
+// settings of the services
+func startRateLimitStats() {
+	go func() {
+		ticker := time.NewTicker(rateLimitStatsInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			writeRateLimitStats(now)
+			sweepServices(now)
+		}
+	}()
+}
+
+func init() {
+	rateLimitsModel := h.JsonServiceRateLimits().DeclareModel()
+	rateLimitsModel.AddFields(map[string]models.FieldDefinition{
+		"Service":        models.CharField{String: "Service", Required: true, Index: true},
+		"Method":         models.CharField{String: "Method"},
+		"Scope":          models.CharField{String: "Scope", Help: "session, user or ip"},
+		"Day":            models.DateField{String: "Day", Required: true, Index: true},
+		"Hits":           models.IntegerField{String: "Rate Limited Requests", GoType: new(int64)},
+		"Disconnections": models.IntegerField{String: "Disconnections", GoType: new(int64)},
+	})
+	rateLimitsModel.AddSQLConstraint("service_method_scope_day_unique", "unique(service, method, scope, day)",
+		"Rate limit counts must be unique per service, method, scope and day")
+	rateLimitsModel.SetDefaultOrder("Day DESC", "Service", "Method")
+}
@@ -0,0 +1,110 @@
+package websocket
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/olahol/melody"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	type step struct {
+		at   time.Duration
+		want time.Duration
+	}
+	tests := []struct {
+		name  string
+		limit RateLimit
+		steps []step
+	}{
+		{"burst", RateLimit{Rate: 1, Burst: 2}, []step{
+			{0, 0}, {0, 0}, {0, time.Second}, {500 * time.Millisecond, 500 * time.Millisecond},
+			{time.Second, 0}, {time.Second, time.Second},
+		}},
+		{"refill", RateLimit{Rate: 10, Burst: 1}, []step{
+			{0, 0}, {0, 100 * time.Millisecond}, {50 * time.Millisecond, 50 * time.Millisecond},
+			{100 * time.Millisecond, 0}, {time.Minute, 0}, {time.Minute, 100 * time.Millisecond},
+		}},
+		{"capped at burst", RateLimit{Rate: 1, Burst: 2}, []step{
+			{0, 0}, {0, 0}, {time.Hour, 0}, {time.Hour, 0}, {time.Hour, time.Second},
+		}},
+		{"clock going back", RateLimit{Rate: 1, Burst: 1}, []step{
+			{time.Second, 0}, {0, time.Second}, {2 * time.Second, 0},
+		}},
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		var b tokenBucket
+		for i, s := range tt.steps {
+			got := b.take(tt.limit, start.Add(s.at))
+			if diff := got - s.want; diff < -time.Microsecond || diff > time.Microsecond {
+				t.Errorf("%s: take %d at %v = %v, want %v", tt.name, i, s.at, got, s.want)
+			}
+		}
+	}
+}
+
+func TestTakeAll(t *testing.T) {
+	var rl rateLimiter
+	now := time.Now()
+	session := bucketLimit{key: bucketKey{method: "m", scope: RateLimitSession, key: "s"}, limit: RateLimit{Rate: 1, Burst: 3}}
+	ip := bucketLimit{key: bucketKey{method: "m", scope: RateLimitIP, key: "ip"}, limit: RateLimit{Rate: 1, Burst: 1}}
+
+	if exceeded, _ := rl.takeAll([]bucketLimit{session, ip}, now); exceeded != -1 {
+		t.Fatalf("first request refused by bucket %d", exceeded)
+	}
+	for i := 0; i < 3; i++ {
+		exceeded, wait := rl.takeAll([]bucketLimit{session, ip}, now)
+		if exceeded != 1 || wait <= 0 {
+			t.Fatalf("request %d: takeAll() = %d, %v, want the IP bucket", i, exceeded, wait)
+		}
+	}
+	// The refused requests took no token from the session bucket
+	if got := rl.buckets[session.key].tokens; got != 2 {
+		t.Errorf("session bucket has %v tokens, want 2", got)
+	}
+
+	rl.sweep(now.Add(2 * time.Second))
+	if _, ok := rl.buckets[session.key]; !ok {
+		t.Error("bucket swept before being refilled")
+	}
+	if _, ok := rl.buckets[ip.key]; ok {
+		t.Error("refilled bucket not swept")
+	}
+	rl.sweep(now.Add(4 * time.Second))
+	if len(rl.buckets) != 0 {
+		t.Errorf("%d buckets left after they were refilled", len(rl.buckets))
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	service := &Service{trustedProxies: parseTrustedProxies([]string{"10.0.0.0/8", " ::1 ", "192.168.1.1", "invalid"})}
+	if len(service.trustedProxies) != 3 {
+		t.Fatalf("%d trusted proxies parsed, want 3", len(service.trustedProxies))
+	}
+	tests := []struct {
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"203.0.113.5:4000", nil, "203.0.113.5"},
+		{"203.0.113.5:4000", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"10.1.2.3:4000", nil, "10.1.2.3"},
+		{"10.1.2.3:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"[::1]:4000", []string{"198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"192.168.1.1:4000", []string{"1.2.3.4, 198.51.100.1", "10.0.0.2"}, "198.51.100.1"},
+		{"192.168.1.2:4000", []string{"198.51.100.1"}, "192.168.1.2"},
+		{"10.1.2.3:4000", []string{"10.0.0.9"}, "10.0.0.9"},
+	}
+	for _, tt := range tests {
+		request := &http.Request{RemoteAddr: tt.remote, Header: make(http.Header)}
+		for _, header := range tt.forwarded {
+			request.Header.Add("X-Forwarded-For", header)
+		}
+		s := &Session{Session: &melody.Session{Request: request}}
+		if got := service.clientAddress(s); got != tt.want {
+			t.Errorf("clientAddress(%s, %v) = %s, want %s", tt.remote, tt.forwarded, got, tt.want)
+		}
+	}
+}
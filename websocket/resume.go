@@ -0,0 +1,334 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/server"
+)
+
+// resumeTokenSize is the number of random bytes of a resume token
+const resumeTokenSize = 32
+
+// ResumeParams is the format of the parameters of resume. Token is the
+// resume token returned by the last login, device_login or resume of the
+// session, and LastSeq the seq of the last message received.
+type ResumeParams struct {
+	SID     string `json:"sid"`
+	Token   string `json:"token"`
+	LastSeq int64  `json:"last_seq"`
+}
+
+// ResumeResponse is the result of resume. ResumeToken replaces the token
+// used to resume the session.
+type ResumeResponse struct {
+	SID         string `json:"sid"`
+	ResumeToken string `json:"resume_token"`
+	UID         int64  `json:"uid,omitempty"`
+	ULID        string `json:"ulid,omitempty"`
+	Device      string `json:"device,omitempty"`
+	// Seq is the sequence number of the last message sent before the
+	// response, and Replayed the number of replayed messages. Complete is
+	// false if messages after last_seq were dropped from the outbox, in
+	// which case the client must reload its state.
+	Seq      int64    `json:"seq"`
+	Replayed int      `json:"replayed"`
+	Complete bool     `json:"complete"`
+	Topics   []string `json:"topics"`
+}
+
+// An outboxMessage is a message sent to a client with its sequence number
+type outboxMessage struct {
+	seq  int64
+	data json.RawMessage
+}
+
+// An outbox numbers the messages sent to a client and keeps the last ones,
+// so that they can be replayed when the client resumes its session after a
+// reconnection. The messages are written to the session it is attached to.
+// While detached, they are only buffered.
+type outbox struct {
+	mutex      sync.Mutex
+	size       int
+	maxBytes   int
+	bytes      int
+	seq        int64
+	messages   []outboxMessage
+	session    *Session
+	detachDate time.Time
+}
+
+// newOutbox returns the outbox of the given new session, or nil if session
+// resumption is disabled for its service.
+func newOutbox(s *Session) *outbox {
+	config := s.Service.Settings
+	if config == nil || config.ResumeGracePeriod <= 0 || config.OutboxSize <= 0 || config.OutboxMaxBytes <= 0 {
+		return nil
+	}
+	return &outbox{size: config.OutboxSize, maxBytes: config.OutboxMaxBytes, session: s}
+}
+
+// withSeq returns the JSON encoding of v with a "seq" member first. The seq
+// member is an extension of JSON-RPC 2.0, which does not define it: it is
+// only added to the messages of services that enable session resumption,
+// whose clients must accept it in responses and notifications. It counts
+// the messages sent to the client of a session from 1, and is given back
+// as the last_seq of resume.
+func withSeq(v interface{}, seq int64) (json.RawMessage, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) < 2 || data[0] != '{' {
+		return nil, fmt.Errorf("cannot number message %s", data)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"seq":`)
+	buf.WriteString(strconv.FormatInt(seq, 10))
+	if rest := bytes.TrimSpace(data[1:]); len(rest) > 0 && rest[0] != '}' {
+		buf.WriteByte(',')
+	}
+	buf.Write(data[1:])
+	return buf.Bytes(), nil
+}
+
+// send numbers v, buffers it and writes it to the attached session
+func (o *outbox) send(v interface{}) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	data, err := withSeq(v, o.seq+1)
+	if err != nil {
+		return err
+	}
+	o.seq++
+	o.messages = append(o.messages, outboxMessage{seq: o.seq, data: data})
+	o.bytes += len(data)
+	var dropped int
+	for dropped < len(o.messages) && (len(o.messages)-dropped > o.size || o.bytes > o.maxBytes) {
+		o.bytes -= len(o.messages[dropped].data)
+		dropped++
+	}
+	o.messages = o.messages[dropped:]
+	if o.session == nil {
+		return nil
+	}
+	return o.session.write(data)
+}
+
+// detach stops writing messages to the session of the outbox
+func (o *outbox) detach() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.session = nil
+	o.detachDate = time.Now()
+}
+
+// expired returns true if the outbox has been detached for more than grace
+func (o *outbox) expired(now time.Time, grace time.Duration) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.session == nil && now.Sub(o.detachDate) > grace
+}
+
+// attach writes the messages sent after lastSeq to s, then attaches the
+// outbox to s. It returns the number of replayed messages, false if some
+// of the messages after lastSeq are no longer buffered, and the sequence
+// number of the last message.
+func (o *outbox) attach(s *Session, lastSeq int64) (int, bool, int64, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	complete := lastSeq >= o.seq || (len(o.messages) > 0 && o.messages[0].seq <= lastSeq+1)
+	var replayed int
+	for _, msg := range o.messages {
+		if msg.seq <= lastSeq {
+			continue
+		}
+		if err := s.write(msg.data); err != nil {
+			return replayed, complete, o.seq, err
+		}
+		replayed++
+	}
+	o.session = s
+	return replayed, complete, o.seq, nil
+}
+
+// detachSession keeps the state of a disconnected session for the grace
+// period of the service, so that its client can resume it. Only the
+// sessions of logged in users and devices are kept.
+func (service *Service) detachSession(session *Session) {
+	if session.outbox == nil || (session.UID == 0 && session.DeviceID == 0) {
+		return
+	}
+	session.outbox.detach()
+	service.expireDetachedSessions(time.Now())
+	service.detachedMutex.Lock()
+	defer service.detachedMutex.Unlock()
+	if service.detached == nil {
+		service.detached = make(map[string]*Session)
+	}
+	service.detached[session.SID] = session
+}
+
+// newResumeToken returns a new random resume token
+func newResumeToken() string {
+	token := make([]byte, resumeTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		log.Panic("Unable to generate resume token", "error", err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// issueResumeToken gives a new resume token to the session and returns it.
+// It returns an empty string if session resumption is disabled.
+func (s *Session) issueResumeToken() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.outbox == nil {
+		return ""
+	}
+	s.resumeToken = newResumeToken()
+	return s.resumeToken
+}
+
+// validResumeToken returns true if token is the resume token of the session
+func (s *Session) validResumeToken(token string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.resumeToken != "" && subtle.ConstantTimeCompare([]byte(s.resumeToken), []byte(token)) == 1
+}
+
+// takeDetachedSession returns and forgets the detached session with the
+// given SID and resume token, or nil if there is none or if its grace
+// period is over. A wrong token leaves the session to its client.
+func (service *Service) takeDetachedSession(sid, token string) *Session {
+	service.detachedMutex.Lock()
+	defer service.detachedMutex.Unlock()
+	session := service.detached[sid]
+	if session == nil || !session.validResumeToken(token) {
+		return nil
+	}
+	delete(service.detached, sid)
+	if session.outbox.expired(time.Now(), service.Settings.ResumeGracePeriod) {
+		return nil
+	}
+	return session
+}
+
+// detachedSessions returns the detached sessions of the service
+func (service *Service) detachedSessions() []*Session {
+	service.detachedMutex.Lock()
+	defer service.detachedMutex.Unlock()
+	res := make([]*Session, 0, len(service.detached))
+	for _, session := range service.detached {
+		res = append(res, session)
+	}
+	return res
+}
+
+// expireDetachedSessions forgets the detached sessions whose grace period
+// is over
+func (service *Service) expireDetachedSessions(now time.Time) {
+	service.detachedMutex.Lock()
+	defer service.detachedMutex.Unlock()
+	for sid, session := range service.detached {
+		if session.outbox.expired(now, service.Settings.ResumeGracePeriod) {
+			delete(service.detached, sid)
+		}
+	}
+}
+
+// adopt restores in s the identity, subscriptions and pending requests of
+// the detached session old. s takes the SID of old.
+func (s *Session) adopt(old *Session) {
+	old.mutex.Lock()
+	topics := make([]string, 0, len(old.topics))
+	for topic := range old.topics {
+		topics = append(topics, topic)
+	}
+	pending := old.pending
+	old.pending = nil
+	old.mutex.Unlock()
+
+	s.SID = old.SID
+	s.UID = old.UID
+	s.ULID = old.ULID
+	s.DeviceID = old.DeviceID
+	s.DeviceULID = old.DeviceULID
+	s.DeviceType = old.DeviceType
+	for _, key := range []string{"login", "company_id", "device"} {
+		if value, ok := old.Get(key); ok {
+			s.Set(key, value)
+		}
+	}
+	s.Subscribe(topics...)
+	s.mutex.Lock()
+	if s.pending == nil {
+		s.pending = make(map[int64]pendingCall)
+	}
+	for id, call := range pending {
+		s.pending[id] = call
+	}
+	s.mutex.Unlock()
+}
+
+// JsonRPCResume resumes the session with the given SID and resume token
+// after a reconnection. It restores its user or device and its
+// subscriptions, then replays the messages sent after last_seq, before the
+// response.
+func JsonRPCResume(s *Session, r *RequestRPC) (interface{}, error) {
+	var params ResumeParams
+	if r.Params == nil || json.Unmarshal(*r.Params, &params) != nil || params.SID == "" || params.Token == "" {
+		return NewResponseError(r, ErrorCodeInvalidParams, "Invalid resume parameters", nil), nil
+	}
+	if s.outbox == nil {
+		return NewResponseError(r, ErrorCodeInvalidRequest, "Session resumption is disabled", nil), nil
+	}
+	if s.UID != 0 || s.DeviceID != 0 {
+		return NewResponseError(r, ErrorCodeInvalidRequest, "Session already logged in", nil), nil
+	}
+	old := s.Service.takeDetachedSession(params.SID, params.Token)
+	if old == nil {
+		return NewResponseError(r, ErrorCodeNotFound, "Session not found or expired", nil), nil
+	}
+	s.adopt(old)
+	// The messages sent to s before the resumption are numbered by its own
+	// outbox, which is dropped: the numbering of the old session goes on.
+	replayed, complete, seq, err := old.outbox.attach(s, params.LastSeq)
+	s.mutex.Lock()
+	s.outbox = old.outbox
+	s.mutex.Unlock()
+	token := s.issueResumeToken()
+	if err != nil {
+		log.Info("Replay error", "session", s.SID, "error", err)
+	}
+	updateConnectionIdentity(s)
+	if s.DeviceID != 0 {
+		deviceConnected(s.DeviceID)
+	}
+	log.Info(fmt.Sprintf("%s: Session %s resumed (%d messages replayed)", s.Service.Name, s.SID, replayed))
+
+	response := &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result: &ResumeResponse{
+			SID:         s.SID,
+			ResumeToken: token,
+			UID:         s.UID,
+			ULID:        s.ULID,
+			Device:      s.DeviceULID,
+			Seq:         seq,
+			Replayed:    replayed,
+			Complete:    complete,
+			Topics:      s.Topics(),
+		},
+	}
+	return response, nil
+}
@@ -0,0 +1,144 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWithSeq(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		want    string
+		wantErr bool
+	}{
+		{map[string]interface{}{}, `{"seq":3}`, false},
+		{map[string]interface{}{"method": "ping"}, `{"seq":3,"method":"ping"}`, false},
+		{struct {
+			ID     int64 `json:"id"`
+			Result int   `json:"result"`
+		}{7, 1}, `{"seq":3,"id":7,"result":1}`, false},
+		{json.RawMessage(` { "a" : 1 } `), `{"seq":3,"a":1}`, false},
+		{json.RawMessage(`{ }`), `{"seq":3}`, false},
+		{[]int{1, 2}, "", true},
+		{"text", "", true},
+		{nil, "", true},
+	}
+	for _, tt := range tests {
+		got, err := withSeq(tt.value, 3)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("withSeq(%v) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if err == nil && string(got) != tt.want {
+			t.Errorf("withSeq(%v) = %s, want %s", tt.value, got, tt.want)
+		}
+		if err == nil && !json.Valid(got) {
+			t.Errorf("withSeq(%v) = %s, not valid JSON", tt.value, got)
+		}
+	}
+}
+
+// seqs returns the seq members of the given messages
+func seqs(t *testing.T, messages [][]byte) []int64 {
+	var res []int64
+	for _, msg := range messages {
+		var numbered struct {
+			Seq int64 `json:"seq"`
+		}
+		if err := json.Unmarshal(msg, &numbered); err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, numbered.Seq)
+	}
+	return res
+}
+
+func TestOutboxAttach(t *testing.T) {
+	message := func(i int) map[string]interface{} { return map[string]interface{}{"n": i} }
+	size := len(`{"seq":1,"n":1}`)
+	tests := []struct {
+		name         string
+		size         int
+		maxBytes     int
+		sent         int
+		lastSeq      int64
+		wantSeqs     string
+		wantComplete bool
+	}{
+		{"nothing missed", 4, 1 << 10, 3, 3, "[]", true},
+		{"client ahead", 4, 1 << 10, 3, 5, "[]", true},
+		{"replay", 4, 1 << 10, 3, 1, "[2 3]", true},
+		{"replay all", 4, 1 << 10, 3, 0, "[1 2 3]", true},
+		{"bounded by count", 2, 1 << 10, 5, 2, "[4 5]", false},
+		{"bounded by count, complete", 2, 1 << 10, 5, 3, "[4 5]", true},
+		{"bounded by bytes", 8, 3 * size, 6, 0, "[4 5 6]", false},
+		{"larger than the bytes", 8, size - 1, 2, 0, "[]", false},
+	}
+	for _, tt := range tests {
+		old, _ := newTestSession(nil)
+		o := &outbox{size: tt.size, maxBytes: tt.maxBytes, session: old}
+		for i := 1; i <= tt.sent; i++ {
+			if err := o.send(message(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		o.detach()
+		s, transport := newTestSession(nil)
+		replayed, complete, seq, err := o.attach(s, tt.lastSeq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := fmt.Sprint(seqs(t, transport.text))
+		if got != tt.wantSeqs || replayed != len(transport.text) {
+			t.Errorf("%s: replayed %s (%d), want %s", tt.name, got, replayed, tt.wantSeqs)
+		}
+		if complete != tt.wantComplete {
+			t.Errorf("%s: complete = %v, want %v", tt.name, complete, tt.wantComplete)
+		}
+		if seq != int64(tt.sent) {
+			t.Errorf("%s: seq = %d, want %d", tt.name, seq, tt.sent)
+		}
+		if o.bytes > tt.maxBytes {
+			t.Errorf("%s: %d bytes buffered, want at most %d", tt.name, o.bytes, tt.maxBytes)
+		}
+		// The outbox writes the next messages to the attached session
+		o.send(message(0))
+		if n := len(transport.text); n != replayed+1 {
+			t.Errorf("%s: %d messages written after attach, want %d", tt.name, n, replayed+1)
+		}
+	}
+}
+
+func TestTakeDetachedSession(t *testing.T) {
+	s, _ := newTestSession(&ServiceConfig{ResumeGracePeriod: time.Minute, OutboxSize: 8, OutboxMaxBytes: 1 << 10})
+	s.UID = 2
+	s.outbox = newOutbox(s)
+	token := s.issueResumeToken()
+	if token == "" || token == s.issueResumeToken() {
+		t.Fatal("resume tokens are not renewed")
+	}
+	token = s.issueResumeToken()
+	service := s.Service
+	service.detachSession(s)
+
+	if service.takeDetachedSession(s.SID, "") != nil {
+		t.Error("session resumed without token")
+	}
+	if service.takeDetachedSession(s.SID, token+"0") != nil {
+		t.Error("session resumed with a wrong token")
+	}
+	if service.takeDetachedSession(s.SID, token) != s {
+		t.Fatal("session not resumed with its token after wrong attempts")
+	}
+	if service.takeDetachedSession(s.SID, token) != nil {
+		t.Error("session resumed twice")
+	}
+
+	disabled, _ := newTestSession(nil)
+	disabled.outbox = newOutbox(disabled)
+	if disabled.outbox != nil || disabled.issueResumeToken() != "" {
+		t.Error("resume token issued with session resumption disabled")
+	}
+}
@@ -0,0 +1,170 @@
+package websocket
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/pool/h"
+)
+
+const (
+	// LogPurgeInterval is the period of the purge of old message logs
+	LogPurgeInterval = time.Hour
+	// logPurgeBatchSize is the maximum number of logs purged in a transaction
+	logPurgeBatchSize = 5000
+)
+
+// An archivedLog is a message log written to an archive file
+type archivedLog struct {
+	ID        int64  `db:"id" json:"id"`
+	Service   string `db:"service" json:"service"`
+	Session   string `db:"session" json:"session"`
+	UnixTime  int64  `db:"unix_time" json:"unix_time"`
+	PeerTime  int64  `db:"peer_time" json:"peer_time,omitempty"`
+	Response  bool   `db:"response" json:"response"`
+	Method    string `db:"method" json:"method,omitempty"`
+	Outbound  bool   `db:"outbound" json:"outbound"`
+	Content   string `db:"content" json:"content,omitempty"`
+	Truncated bool   `db:"truncated" json:"truncated,omitempty"`
+}
+
+// archiveLogs appends the given logs to the gzipped JSON-lines files of dir.
+// There is one file per service and day: <service>-<YYYY-MM-DD>.jsonl.gz.
+// Each call appends a gzip member to the file, which gzip readers handle as
+// a single stream.
+func archiveLogs(dir string, logs []archivedLog) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	files := make(map[string][]archivedLog)
+	for _, l := range logs {
+		day := time.Unix(0, l.UnixTime*int64(time.Millisecond)).UTC().Format("2006-01-02")
+		name := filepath.Join(dir, fmt.Sprintf("%s-%s.jsonl.gz", l.Service, day))
+		files[name] = append(files[name], l)
+	}
+	for name, entries := range files {
+		if err := appendArchive(name, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendArchive appends the given logs to the archive file with the given name
+func appendArchive(name string, logs []archivedLog) error {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	encoder := json.NewEncoder(gz)
+	for _, l := range logs {
+		if err := encoder.Encode(&l); err != nil {
+			gz.Close()
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// purgeLogsBatch aggregates, archives if the service has an archive directory,
+// and deletes the oldest logs of the service that are older than cutoff. It
+// returns the number of purged logs.
+func purgeLogsBatch(service *Service, cutoff int64) (int, error) {
+	var count int
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		logsTable := h.JsonServiceLogs().TableName()
+		var logs []archivedLog
+		env.Cr().Select(&logs, fmt.Sprintf(`SELECT id, service, COALESCE(session, '') AS session,
+			unix_time, COALESCE(peer_time, 0) AS peer_time, COALESCE(response, false) AS response,
+			COALESCE(method, '') AS method, COALESCE(outbound, false) AS outbound,
+			COALESCE(content, '') AS content, COALESCE(truncated, false) AS truncated
+			FROM %s WHERE service = ? AND unix_time < ? ORDER BY id LIMIT ?`, logsTable),
+			service.Name, cutoff, logPurgeBatchSize)
+		count = len(logs)
+		if count == 0 {
+			return
+		}
+		// The selected logs are all the logs older than cutoff up to this ID
+		maxID := logs[count-1].ID
+		if dir := service.Settings.LogArchiveDir; dir != "" {
+			if err := archiveLogs(dir, logs); err != nil {
+				log.Panic("Unable to archive message logs", "service", service.Name, "error", err)
+			}
+		}
+		env.Cr().Execute(fmt.Sprintf(`INSERT INTO %s (service, method, day, outbound, count,
+			create_date, write_date, hexya_external_id, hexya_version)
+			SELECT service, COALESCE(method, ''), (to_timestamp(unix_time / 1000) AT TIME ZONE 'UTC')::date, COALESCE(outbound, false), count(*),
+			now(), now(), md5(random()::text || clock_timestamp()::text), 0
+			FROM %s WHERE service = ? AND unix_time < ? AND id <= ?
+			GROUP BY service, COALESCE(method, ''), (to_timestamp(unix_time / 1000) AT TIME ZONE 'UTC')::date, COALESCE(outbound, false)
+			ON CONFLICT (service, method, day, outbound)
+			DO UPDATE SET count = %s.count + EXCLUDED.count, write_date = now()`,
+			h.JsonServiceLogStats().TableName(), logsTable, h.JsonServiceLogStats().TableName()),
+			service.Name, cutoff, maxID)
+		env.Cr().Execute(fmt.Sprintf(`DELETE FROM %s WHERE service = ? AND unix_time < ? AND id <= ?`, logsTable),
+			service.Name, cutoff, maxID)
+	})
+	return count, err
+}
+
+// purgeLogs purges the logs of all the services that are older than their
+// retention period. Logs are first counted by method and day in
+// JsonServiceLogStats.
+func purgeLogs(now time.Time) {
+	Services.Range(func(key, value interface{}) bool {
+		service := value.(*Service)
+		days := service.Settings.LogRetentionDays
+		if days <= 0 {
+			return true
+		}
+		cutoff := now.AddDate(0, 0, -days).UnixNano() / int64(time.Millisecond)
+		for {
+			count, err := purgeLogsBatch(service, cutoff)
+			if err != nil {
+				log.Warn("Message logs purge failed", "service", service.Name, "error", err)
+				break
+			}
+			if count < logPurgeBatchSize {
+				break
+			}
+		}
+		return true
+	})
+}
+
+// startLogRetention starts the periodic purge of old message logs
+func startLogRetention() {
+	go func() {
+		purgeLogs(time.Now())
+		ticker := time.NewTicker(LogPurgeInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			purgeLogs(now)
+		}
+	}()
+}
+
+func init() {
+	statsModel := h.JsonServiceLogStats().DeclareModel()
+	statsModel.AddFields(map[string]models.FieldDefinition{
+		"Service":  models.CharField{String: "Service", Required: true, Index: true},
+		"Method":   models.CharField{String: "Method"},
+		"Day":      models.DateField{String: "Day", Required: true, Index: true},
+		"Outbound": models.BooleanField{String: "Outbound"},
+		"Count":    models.IntegerField{String: "Messages", GoType: new(int64)},
+	})
+	statsModel.AddSQLConstraint("service_method_day_unique", "unique(service, method, day, outbound)",
+		"Message counts must be unique per service, method, day and direction")
+	statsModel.SetDefaultOrder("Day DESC", "Service", "Method")
+}
@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	_ "net"
+	"net"
 	_ "strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	_ "github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"github.com/oklog/ulid"
 	"github.com/olahol/melody"
 
@@ -44,6 +47,12 @@ const (
 	ErrorCodeInvalidParams ErrorCode = -32602
 	// ErrorCodeInternal is internal error code.
 	ErrorCodeInternal ErrorCode = -32603
+	// ErrorCodeServer is the error code of errors raised while executing a method.
+	ErrorCodeServer ErrorCode = -32000
+	// ErrorCodeNotFound is the error code of requests on unknown entities.
+	ErrorCodeNotFound ErrorCode = -32001
+	// ErrorCodeAccessDenied is the error code of requests the user is not allowed to do.
+	ErrorCodeAccessDenied ErrorCode = -32003
 )
 
 type ErrorCode int
@@ -80,8 +89,11 @@ type ResponseError struct {
 
 // JSONRPCErrorData is the format of the Data field of an Error Response
 type JSONRPCErrorData struct {
-	Arguments string `json:"arguments"`
-	Debug     string `json:"debug"`
+	Arguments     string `json:"arguments"`
+	Debug         string `json:"debug"`
+	Message       string `json:"message,omitempty"`
+	ExceptionType string `json:"exception_type,omitempty"`
+	Index         *int   `json:"index,omitempty"`
 }
 
 // JSONRPCError is the format of an Error in a ResponseError
@@ -100,10 +112,191 @@ type JSONRPCGenericParams struct {
 type Session struct {
 	*melody.Session
 	Service *Service
-	Epoch   int64  `json:"epoch"` // Last
-	UID     int64  `json:"uid"`
-	SID     string `json:"sid"`
-	ULID    string `json:"ulid"`
+	// Epoch is the time of the last activity of the client, in
+	// milliseconds. It is updated by the handlers of the session while the
+	// heartbeat reads it: use lastActive and touch to access it.
+	Epoch int64  `json:"epoch"`
+	UID   int64  `json:"uid"`
+	SID   string `json:"sid"`
+	ULID  string `json:"ulid"`
+	// DeviceID and DeviceULID identify the device logged in the session.
+	// They are independent of the human user given by UID. DeviceType is
+	// the type of the device at login.
+	DeviceID   int64  `json:"device_id"`
+	DeviceULID string `json:"device_ulid"`
+	DeviceType string `json:"device_type"`
+	mutex      sync.Mutex
+	topics     map[string]bool
+	codec      Codec
+	pending    map[int64]pendingCall
+	pingID     int64
+	transport  Transport
+	// outbox numbers and buffers the messages sent to the client, so that
+	// they can be replayed when the session is resumed. It is nil if
+	// session resumption is disabled. resumeToken is the secret the client
+	// must give to resume the session; it is never logged.
+	outbox      *outbox
+	resumeToken string
+	// ClockOffset is the estimated time of the client minus the time of
+	// the server and Latency the estimated round trip time, in milliseconds.
+	// They are computed from ping exchanges.
+	ClockOffset int64 `json:"clock_offset"`
+	Latency     int64 `json:"latency"`
+	// connectionID is the ID of the JsonServiceConnection record of the
+	// session and activityDate the time its activity was last recorded.
+	connectionID  int64
+	activityDate  time.Time
+	clockSamples  int
+	clockDrifting bool
+	removed       bool
+	// violations counts the rate limited requests since violationDate
+	violations    int
+	violationDate time.Time
+}
+
+// A Transport carries the messages of sessions that are not websocket
+// connections, such as the devices connected through the MQTT bridge.
+type Transport interface {
+	Write(msg []byte) error
+	WriteBinary(msg []byte) error
+	Close() error
+}
+
+// Write writes a text message to the client of the session
+func (s *Session) Write(msg []byte) error {
+	if s.transport != nil {
+		return s.transport.Write(msg)
+	}
+	return s.Session.Write(msg)
+}
+
+// WriteBinary writes a binary message to the client of the session
+func (s *Session) WriteBinary(msg []byte) error {
+	if s.transport != nil {
+		return s.transport.WriteBinary(msg)
+	}
+	return s.Session.WriteBinary(msg)
+}
+
+// Close closes the connection of the session
+func (s *Session) Close() error {
+	if s.transport != nil {
+		return s.transport.Close()
+	}
+	return s.Session.Close()
+}
+
+// CallTimeout is the time a client has to answer a request sent with Call.
+// The handler of the request is then forgotten.
+const CallTimeout = time.Minute
+
+// A pendingCall is the handler of a request waiting for the answer of the
+// client
+type pendingCall struct {
+	handler JsonRPCHandleResponseFunc
+	expires time.Time
+}
+
+// nextRequestID returns a new ID for a request sent to a client
+func (service *Service) nextRequestID() int64 {
+	return atomic.AddInt64(&service.lastRequestID, 1)
+}
+
+// Call sends a request to the client of the session. The given handler is
+// called with the response of the client, unless it arrives after
+// CallTimeout. It returns the ID of the request.
+func (s *Session) Call(method string, params interface{}, handler JsonRPCHandleResponseFunc) (int64, error) {
+	return s.CallWithID(s.Service.nextRequestID(), method, params, handler)
+}
+
+// CallWithID is Call with the given request ID. It sends a request again
+// without leaving the handler of the previous attempt behind: handler
+// replaces the handler registered for id, if any.
+func (s *Session) CallWithID(id int64, method string, params interface{}, handler JsonRPCHandleResponseFunc) (int64, error) {
+	request := struct {
+		JsonRPC string      `json:"jsonrpc"`
+		ID      int64       `json:"id"`
+		Method  string      `json:"method"`
+		Params  interface{} `json:"params"`
+	}{JsonRPC: "2.0", ID: id, Method: method, Params: params}
+	if handler != nil {
+		now := time.Now()
+		s.mutex.Lock()
+		if s.pending == nil {
+			s.pending = make(map[int64]pendingCall)
+		}
+		// Forget the handlers of the requests that were never answered
+		for pid, call := range s.pending {
+			if now.After(call.expires) {
+				delete(s.pending, pid)
+			}
+		}
+		s.pending[id] = pendingCall{handler: handler, expires: now.Add(CallTimeout)}
+		s.mutex.Unlock()
+	}
+	if err := s.Send(&request); err != nil {
+		s.popPending(id)
+		return 0, err
+	}
+	return id, nil
+}
+
+// popPending returns and forgets the handler of the response with the given
+// ID, or nil if no request with this ID is waiting for a response.
+func (s *Session) popPending(id int64) JsonRPCHandleResponseFunc {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	call, ok := s.pending[id]
+	delete(s.pending, id)
+	if !ok || time.Now().After(call.expires) {
+		return nil
+	}
+	return call.handler
+}
+
+// waiting returns true if the request with the given ID is waiting for the
+// answer of the client
+func (s *Session) waiting(id int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	call, ok := s.pending[id]
+	return ok && !time.Now().After(call.expires)
+}
+
+// Codec returns the codec negotiated by the client of the session
+func (s *Session) Codec() Codec {
+	if s.codec == nil {
+		return defaultCodec
+	}
+	return s.codec
+}
+
+// Send encodes v with the codec of the session and writes it to the client.
+// If session resumption is enabled, the message is numbered with a "seq"
+// member (see withSeq) and kept in the outbox of the session.
+func (s *Session) Send(v interface{}) error {
+	s.mutex.Lock()
+	o := s.outbox
+	s.mutex.Unlock()
+	if o != nil {
+		return o.send(v)
+	}
+	return s.write(v)
+}
+
+// write encodes v with the codec of the session, logs it and writes it to
+// the client
+func (s *Session) write(v interface{}) error {
+	codec := s.Codec()
+	msg, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.Service.Log(s, codec, msg, true)
+	if codec.Binary() {
+		return s.WriteBinary(msg)
+	}
+	return s.Write(msg)
 }
 
 //type JsonRPCHandler func(c context.Context, params *json.RawMessage) (result interface{}, err *error)
@@ -117,13 +310,30 @@ type HandleMessageFunc func(*Session, []byte)
 
 type Service struct {
 	*melody.Melody
-	mutex     sync.RWMutex
-	Name      string
-	mw        []HandleMessageFunc
-	mwb       []HandleMessageFunc
-	methods   map[string]JsonRPCHandleFunc
-	responses map[string]JsonRPCHandleResponseFunc
-	Sessions  sync.Map
+	mutex         sync.RWMutex
+	Name          string
+	Settings      *ServiceConfig
+	Debug         bool
+	MaxUploadSize int64 // Maximum size of files uploaded in binary frames
+	redactFields  map[string]bool
+	mw            []HandleMessageFunc
+	mwb           []HandleMessageFunc
+	methods       map[string]JsonRPCHandleFunc
+	responses     map[string]JsonRPCHandleResponseFunc
+	Sessions      sync.Map
+	lastRequestID int64
+	done          chan struct{}
+	// detached are the sessions of disconnected clients that can still be
+	// resumed, by SID
+	detached      map[string]*Session
+	detachedMutex sync.Mutex
+	// closing is set when the service shuts down and inflight counts the
+	// message handlers that are running
+	closing  bool
+	inflight sync.WaitGroup
+	limiter  rateLimiter
+	// trustedProxies are the parsed TrustedProxies of the settings
+	trustedProxies []*net.IPNet
 }
 
 var Services sync.Map
@@ -158,43 +368,6 @@ func (s *Service) RegisterResponser(method string, h JsonRPCHandleResponseFunc)
 	return nil
 }
 
-func (service *Service) Log(s *Session, request *RequestRPC, msg []byte) {
-
-	/*
-		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
-			var peerTime int64
-			var params JSONRPCGenericParams
-			var rsp bool
-			if request == nil {
-				return
-			}
-
-			if request.Params != nil {
-				json.Unmarshal(*request.Params, &params)
-				peerTime = params.Epoch
-			} else {
-				rsp = true
-				if request.Error != nil {
-					peerTime = request.Error.Epoch
-				} else if request.Result != nil {
-					json.Unmarshal(*request.Result, &params)
-					peerTime = params.Epoch
-				}
-			}
-			logData := &h.JsonServiceLogsData{
-				Service:  service.Name,
-				Session:  s.SID,
-				Method:   request.Method,
-				Response: rsp,
-				PeerTime: peerTime,
-				//Content:  types.JSONText(msg),
-			}
-			h.JsonServiceLogs().Create(env, logData)
-		})
-	*/
-	return
-}
-
 /*
 func (service *Service) Send(sid string, data interface{}) error {
 	var session interface{}
@@ -213,21 +386,27 @@ func (service *Service) Send(sid string, data interface{}) error {
 }
 */
 
+// Dispatch calls the handler of the given JSON message
 func (service *Service) Dispatch(s *Session, msg []byte) (interface{}, error) {
+	return service.DispatchCodec(s, defaultCodec, msg)
+}
+
+// DispatchCodec calls the handler of the given message encoded with codec
+func (service *Service) DispatchCodec(s *Session, codec Codec, msg []byte) (interface{}, error) {
 	var data interface{}
 	var err error
 	var request RequestRPC
-	err = json.Unmarshal(msg, &request)
+	err = codec.Unmarshal(msg, &request)
 	if err != nil {
-		return nil, errors.New("Unmarshal JSON data error:" + err.Error())
+		return nil, errors.New("Unmarshal " + codec.Name() + " data error:" + err.Error())
 	}
 	if request.JsonRPC == "" {
-		return nil, errors.New("Unmarshal JSON data error(JsonRPC = null):" + err.Error())
+		return nil, errors.New("Unmarshal " + codec.Name() + " data error(JsonRPC = null)")
 	}
-	service.Log(s, &request, msg)
+	service.Log(s, codec, msg, false)
 	if request.Params == nil {
 		var response ResponseRPC
-		err = json.Unmarshal(msg, &response)
+		err = codec.Unmarshal(msg, &response)
 		if err != nil {
 			ss := fmt.Sprintf("Service `%s` ResponseRPC: Unmarshal Error", service.Name)
 			log.Info(ss)
@@ -239,10 +418,15 @@ func (service *Service) Dispatch(s *Session, msg []byte) (interface{}, error) {
 			return nil, nil
 		}
 
+		if fn := s.popPending(response.ID); fn != nil {
+			fn(s, &response)
+			return nil, nil
+		}
+
 		methodName := response.Method
 
 		if methodName == "" {
-			ss := fmt.Sprintf("Service `%s` ResponseRPC: empty method. TODO: Search in session", service.Name)
+			ss := fmt.Sprintf("Service `%s` ResponseRPC: empty method and unknown request ID %d", service.Name, response.ID)
 			log.Info(ss)
 			return nil, nil
 		}
@@ -261,6 +445,9 @@ func (service *Service) Dispatch(s *Session, msg []byte) (interface{}, error) {
 		return nil, nil
 	}
 
+	if res := service.rateLimit(s, &request); res != nil {
+		return res, nil
+	}
 	methodName := request.Method
 	fn, ok := service.methods[methodName]
 	if !ok {
@@ -312,128 +499,149 @@ func (service *Service) GetSession(s *melody.Session) *Session {
 	return session
 }
 
+// MessageTooLargeData is the data of the error answering a message larger
+// than the MaxMessageSize setting of the service
+type MessageTooLargeData struct {
+	Size    int64 `json:"size"`
+	MaxSize int64 `json:"max_size"`
+}
+
+// rejectOversized answers a message larger than the MaxMessageSize setting
+// with an error, then closes the connection with the "message too big"
+// close code. It returns true if msg was rejected.
+func (service *Service) rejectOversized(s *Session, msg []byte) bool {
+	maxSize := service.Settings.MaxMessageSize
+	if int64(len(msg)) <= maxSize {
+		return false
+	}
+	log.Info(fmt.Sprintf("%s: Closing session %s sending a message too large", service.Name, s.SID),
+		"size", len(msg), "max", maxSize)
+	request := &RequestRPC{JsonRPC: "2.0"}
+	s.Send(NewResponseError(request, ErrorCodeInvalidRequest, "Message too large", &MessageTooLargeData{
+		Size:    int64(len(msg)),
+		MaxSize: maxSize,
+	}))
+	// The close message is queued after the error so that it is sent first
+	s.Session.CloseWithMsg(websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "message too large"))
+	return true
+}
+
+// handleMessage dispatches a message encoded with codec and sends the
+// response back to the client.
+func (service *Service) handleMessage(session *Session, codec Codec, msg []byte) {
+	data, err := service.DispatchCodec(session, codec, msg)
+	if err != nil {
+		log.Info("Dispatch error: " + err.Error())
+	}
+	if data == nil {
+		return
+	}
+	if err = session.Send(data); err != nil {
+		log.Info("Send error: " + err.Error())
+	}
+}
+
+// NewService creates and registers a service with the settings read from
+// the Hexya configuration.
 func NewService(name string) (*Service, error) {
-	var err error
-	var data interface{}
+	return NewServiceWithConfig(name, LoadServiceConfig(name))
+}
+
+// NewServiceWithConfig creates and registers a service with the given settings
+func NewServiceWithConfig(name string, config *ServiceConfig) (*Service, error) {
 	if _, ok := Services.Load(name); ok {
 		return nil, errors.New("Already exist")
 	}
-	service := &Service{Melody: melody.New(), Name: name}
-	service.Config.MaxMessageSize = 4096
+	service := &Service{Melody: melody.New(), Name: name, done: make(chan struct{})}
+	service.Configure(config)
 	service.methods = make(map[string]JsonRPCHandleFunc)
 	service.responses = make(map[string]JsonRPCHandleResponseFunc)
 
 	service.HandleMessage(func(s *melody.Session, msg []byte) {
 		session := service.GetSession(s)
-		if session == nil {
+		if session == nil || !service.beginHandler() {
+			return
+		}
+		defer service.endHandler()
+		session.touch()
+		if service.rejectOversized(session, msg) {
 			return
 		}
-		session.Epoch = int64(ulid.Now())
-		/*
-			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
-				cnnInfo := h.JsonServiceConnection().Search(env, q.JsonServiceConnection().Session().Equals(session.SID))
-				if !cnnInfo.IsEmpty() {
-					cnnData := &h.JsonServiceConnectionData{
-						LastActiveEpoch: session.Epoch,
-					}
-					cnnInfo.Write(cnnData, h.JsonServiceConnection().LastActiveEpoch())
-				}
-			})
-		*/
 		// Call middleware for websocket text
 		for _, fn := range service.mw {
 			fn(session, msg)
 		}
-		data, err = service.Dispatch(session, msg)
-		if err != nil {
-			log.Info("Dispatch error: " + err.Error())
-			if data == nil {
-				return
-			}
-		}
-		if data == nil {
-			return
-		}
-		byteSlice, err := json.Marshal(data)
-		if err == nil {
-			session.Write(byteSlice)
-		} else {
-			session.Write(msg)
-		}
+		service.handleMessage(session, defaultCodec, msg)
 	})
 
 	service.HandleMessageBinary(func(s *melody.Session, msg []byte) {
 		session := service.GetSession(s)
-		if session == nil {
+		if session == nil || !service.beginHandler() {
+			return
+		}
+		defer service.endHandler()
+		session.touch()
+		if service.rejectOversized(session, msg) {
 			return
 		}
-		session.Epoch = int64(ulid.Now())
-		/*
-			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
-				cnnInfo := h.JsonServiceConnection().Search(env, q.JsonServiceConnection().Session().Equals(session.SID))
-				if !cnnInfo.IsEmpty() {
-					cnnData := &h.JsonServiceConnectionData{
-						LastActiveEpoch: session.Epoch,
-					}
-					cnnInfo.Write(cnnData, h.JsonServiceConnection().LastActiveEpoch())
-				}
-			})
-		*/
 		// Call middleware for websocket binary
 		for _, fn := range service.mwb {
 			fn(session, msg)
 		}
-		// Echo binary data
-		session.Write(msg)
+		service.HandleBinary(session, msg)
 	})
 	service.HandleConnect(func(s *melody.Session) {
 		suid := NewULID()
 		session := &Session{Session: s,
 			Service: service,
 			Epoch:   int64(ulid.Now()),
-			SID:     suid}
+			SID:     suid,
+			codec:   negotiatedCodec(s),
+		}
+		session.outbox = newOutbox(session)
 
-		service.Sessions.Store(s, session)
+		service.addSession(session)
 		ss := fmt.Sprintf("%s: Websocket client %s connected (sessionid: %s)", service.Name, s.Request.RemoteAddr, suid)
 		log.Info(ss)
-		/*
-			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
-				cnnData := &h.JsonServiceConnectionData{Service: service.Name,
-					Session:         suid,
-					LastActiveEpoch: session.Epoch,
-				}
-				cnnData.PeerAddress, cnnData.PeerPort, _ = net.SplitHostPort(s.Request.RemoteAddr)
-				h.JsonServiceConnection().Create(env, cnnData)
-			})
-		*/
 	})
 	service.HandleDisconnect(func(s *melody.Session) {
 		session := service.GetSession(s)
 		if session == nil {
 			return
 		}
-		service.Sessions.Delete(s)
-		session.Epoch = int64(ulid.Now())
-		/*
-			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
-				cnnInfo := h.JsonServiceConnection().Search(env, q.JsonServiceConnection().Session().Equals(session.SID))
-				if !cnnInfo.IsEmpty() {
-					cnnData := &h.JsonServiceConnectionData{
-						Offline:         true,
-						LastActiveEpoch: session.Epoch,
-					}
-					cnnInfo.Write(cnnData, h.JsonServiceConnection().Offline(),
-						h.JsonServiceConnection().LastActiveEpoch())
-				}
-			})
-		*/
-		ss := fmt.Sprintf("%s: Websocket client %s disconnected", service.Name, s.Request.RemoteAddr, session.ULID)
+		service.removeSession(session)
+		ss := fmt.Sprintf("%s: Websocket client %s disconnected (sessionid: %s)", service.Name, s.Request.RemoteAddr, session.SID)
 		log.Info(ss)
 	})
 	Services.Store(name, service)
+	go service.heartbeat()
 	return service, nil
 }
 
+// addSession registers a new session of the service
+func (service *Service) addSession(session *Session) {
+	openConnection(session)
+	service.Sessions.Store(session.Session, session)
+	go session.Ping()
+}
+
+// removeSession forgets a session whose client is disconnected. It may be
+// called several times for the same session.
+func (service *Service) removeSession(session *Session) {
+	session.mutex.Lock()
+	removed := session.removed
+	session.removed = true
+	session.mutex.Unlock()
+	if removed {
+		return
+	}
+	service.Sessions.Delete(session.Session)
+	atomic.StoreInt64(&session.Epoch, int64(ulid.Now()))
+	deviceDisconnected(session)
+	closeConnection(session)
+	service.detachSession(session)
+}
+
 func GetService(name string) (*Service, error) {
 	var service interface{}
 	var ok bool
@@ -451,25 +659,12 @@ func NewULID() string {
 	return uid.String()
 }
 
-func ResetAllSession() {
-	/*
-		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
-			env.Cr().Execute("UPDATE json_service_connection SET offline=true where offline=false")
-			//		cnnInfo := h.JsonServiceConnection().Search(env, q.JsonServiceConnection().Session().Equals(session.SID))
-			//		if !cnnInfo.IsEmpty() {
-			//			cnnData := &h.JsonServiceConnectionData{
-			//				LastActiveEpoch: session.Epoch,
-			//			}
-			//			cnnInfo.Write(cnnData, h.JsonServiceConnection().LastActiveEpoch())
-			//		}
-		})
-	*/
-}
 func init() {
 	serviceConnectionModel := h.JsonServiceConnection().DeclareModel()
 	serviceConnectionModel.AddFields(map[string]models.FieldDefinition{
 		"Service":     models.CharField{String: "Service", Index: true},
 		"Session":     models.CharField{String: "Session", Index: true},
+		"Node":        models.CharField{String: "Node", Index: true, Help: "Server instance of the connection"},
 		"PeerAddress": models.CharField{String: "PeerAddress", Index: true},
 		"PeerPort":    models.CharField{String: "PeerPort", Help: "Peer Port"},
 		"ConnectedEpoch": models.IntegerField{
@@ -486,13 +681,69 @@ func init() {
 		},
 		"Offline": models.BooleanField{String: "Offline"},
 		"ULID":    models.CharField{String: "ULID", Index: true},
+		"User":    models.Many2OneField{String: "User", RelationModel: h.User(), Index: true},
+		"Device":  models.Many2OneField{String: "Device", RelationModel: h.Device(), Index: true},
+		"ClockOffset": models.IntegerField{String: "Clock Offset", GoType: new(int64),
+			Help: "Estimated time of the client minus the time of the server, in milliseconds"},
+		"Latency": models.IntegerField{String: "Latency", GoType: new(int64),
+			Help: "Estimated round trip time in milliseconds"},
 	})
 	serviceConnectionModel.SetDefaultOrder("ID DESC")
 
+	serviceConnectionModel.AddMethod("ComputeDuration",
+		`ComputeDuration returns the time the client has been connected, until
+		now for online connections.`,
+		func(rs h.JsonServiceConnectionSet) *h.JsonServiceConnectionData {
+			end := int64(ulid.Now())
+			if rs.Offline() {
+				end = rs.LastActiveEpoch()
+			}
+			return &h.JsonServiceConnectionData{
+				Duration: connectionDuration(rs.ConnectedEpoch(), end),
+			}
+		})
+	serviceConnectionModel.AddFields(map[string]models.FieldDefinition{
+		"Duration": models.CharField{String: "Connected For",
+			Compute: h.JsonServiceConnection().Methods().ComputeDuration()},
+	})
+
+	serviceConnectionModel.AddMethod("ActionDisconnect",
+		`ActionDisconnect closes the live sessions of these connections.
+		Connections without a live session are marked offline.`,
+		func(rs h.JsonServiceConnectionSet) bool {
+			for _, connection := range rs.Records() {
+				if !connectionAction(connection, actionDisconnect) {
+					// Left online by a server that is not running anymore
+					connection.SetOffline(true)
+				}
+			}
+			return true
+		})
+
+	serviceConnectionModel.AddMethod("ActionPing",
+		`ActionPing sends a ping request to the live sessions of these connections.`,
+		func(rs h.JsonServiceConnectionSet) bool {
+			for _, connection := range rs.Records() {
+				connectionAction(connection, actionPing)
+			}
+			return true
+		})
+
+	serviceConnectionModel.AddMethod("ActionRelogin",
+		`ActionRelogin logs out the users of the live sessions of these
+		connections and asks their clients to log in again.`,
+		func(rs h.JsonServiceConnectionSet) bool {
+			for _, connection := range rs.Records() {
+				connectionAction(connection, actionRelogin)
+			}
+			return true
+		})
+
 	serviceLogModel := h.JsonServiceLogs().DeclareModel()
 	serviceLogModel.AddFields(map[string]models.FieldDefinition{
 		"Service": models.CharField{String: "Service", Index: true},
-		"Session": models.CharField{String: "Session", Index: true},
+		"Session": models.CharField{String: "Session", Index: true,
+			Help: "Truncated hash of the session ID"},
 		"UnixTime": models.IntegerField{
 			String: "UnixTime",
 			Help:   "Server Time ",
@@ -506,9 +757,11 @@ func init() {
 			Help:   "Peer Time ",
 			GoType: new(int64),
 		},
-		"Response": models.BooleanField{String: "IsResponse"},
-		"Method":   models.CharField{String: "Method", Required: false},
-		//"Content":  models.JSONField{String: "Content", Index: true},
+		"Response":  models.BooleanField{String: "IsResponse"},
+		"Method":    models.CharField{String: "Method", Required: false},
+		"Outbound":  models.BooleanField{String: "Outbound", Help: "Message sent to the client"},
+		"Content":   models.TextField{String: "Content", Help: "JSON content with secrets redacted"},
+		"Truncated": models.BooleanField{String: "Truncated"},
 	})
 	serviceLogModel.SetDefaultOrder("ID DESC")
 }
@@ -0,0 +1,135 @@
+package websocket
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// A testTransport records the messages written to a session
+type testTransport struct {
+	mutex  sync.Mutex
+	text   [][]byte
+	binary [][]byte
+	closed bool
+}
+
+func (t *testTransport) Write(msg []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.text = append(t.text, append([]byte(nil), msg...))
+	return nil
+}
+
+func (t *testTransport) WriteBinary(msg []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.binary = append(t.binary, append([]byte(nil), msg...))
+	return nil
+}
+
+func (t *testTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	return nil
+}
+
+// newTestSession returns a session of a service with the given settings
+// whose messages are recorded by the returned transport
+func newTestSession(config *ServiceConfig) (*Session, *testTransport) {
+	if config == nil {
+		config = &ServiceConfig{}
+	}
+	transport := new(testTransport)
+	s := &Session{
+		SID:       NewULID(),
+		Service:   &Service{Name: "test", Settings: config},
+		transport: transport,
+	}
+	return s, transport
+}
+
+func TestCallPending(t *testing.T) {
+	s, transport := newTestSession(nil)
+	var answered []string
+	handler := func(name string) JsonRPCHandleResponseFunc {
+		return func(s *Session, response *ResponseRPC) { answered = append(answered, name) }
+	}
+
+	id, err := s.Call("first", nil, handler("first"))
+	if err != nil || id == 0 {
+		t.Fatalf("Call() = %d, %v", id, err)
+	}
+	if _, err := s.CallWithID(id, "first", nil, handler("retry")); err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.text) != 2 || len(s.pending) != 1 {
+		t.Fatalf("%d requests sent and %d pending, want 2 and 1", len(transport.text), len(s.pending))
+	}
+	if fn := s.popPending(id); fn == nil {
+		t.Fatal("popPending() = nil for a waiting request")
+	} else {
+		fn(s, &ResponseRPC{})
+	}
+	if fn := s.popPending(id); fn != nil {
+		t.Error("popPending() returned the handler of an answered request")
+	}
+	if len(answered) != 1 || answered[0] != "retry" {
+		t.Errorf("answered handlers = %v, want [retry]", answered)
+	}
+
+	late, _ := s.Call("late", nil, handler("late"))
+	expired, _ := s.Call("expired", nil, handler("expired"))
+	s.mutex.Lock()
+	call := s.pending[expired]
+	call.expires = time.Now().Add(-time.Second)
+	s.pending[expired] = call
+	s.mutex.Unlock()
+	if s.waiting(expired) {
+		t.Error("waiting() = true for an expired request")
+	}
+	s.Call("next", nil, handler("next"))
+	if _, ok := s.pending[expired]; ok {
+		t.Error("the handler of an expired request was not forgotten")
+	}
+	if !s.waiting(late) {
+		t.Error("the handler of a request in time was forgotten")
+	}
+}
+
+func TestPingWaitsForAnswer(t *testing.T) {
+	s, transport := newTestSession(&ServiceConfig{})
+	for i := 0; i < 3; i++ {
+		if err := s.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(transport.text) != 1 {
+		t.Fatalf("%d pings sent while waiting for an answer, want 1", len(transport.text))
+	}
+	s.popPending(s.pingID)
+	s.Ping()
+	if len(transport.text) != 2 {
+		t.Errorf("%d pings sent after the answer, want 2", len(transport.text))
+	}
+}
+
+func TestTouchConcurrent(t *testing.T) {
+	s, _ := newTestSession(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.touch()
+				s.lastActive()
+			}
+		}()
+	}
+	wg.Wait()
+	if s.lastActive() == 0 {
+		t.Error("touch did not update the epoch of the session")
+	}
+}
@@ -36,10 +36,9 @@ func JsonRPCSessionInfo(s *Session, r *RequestRPC) (interface{}, error) {
 			companyID = user.Company().ID()
 			userName = user.Name()
 		})
-		sid, _ := s.Get("sid")
 		data := gin.H{
 			"epoch":        int64(ulid.Now()),
-			"session_id":   sid,
+			"session_id":   s.SID,
 			"uid":          uid,
 			"user_context": userContext.ToMap(),
 			"db":           "default",
@@ -68,7 +67,7 @@ func JsonRPCSessionInfo(s *Session, r *RequestRPC) (interface{}, error) {
 func JsonRPCModules(s *Session, r *RequestRPC) (interface{}, error) {
 	uid := s.UID
 	if uid == 0 {
-		return nil, errors.New("Access denied")
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
 	}
 	mods := make([]string, len(server.Modules))
 	for i, m := range server.Modules {
@@ -92,7 +91,7 @@ func JsonRPCModules(s *Session, r *RequestRPC) (interface{}, error) {
 func JsonRPCChangePassword(s *Session, r *RequestRPC) (interface{}, error) {
 	uid := s.UID
 	if uid == 0 {
-		return nil, errors.New("Access denied")
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
 	}
 
 	var params hc.ChangePasswordData
@@ -155,7 +154,7 @@ func JsonRPCToken(s *Session, r *RequestRPC) (interface{}, error) {
 
 	uid := s.UID
 	if uid == 0 {
-		return nil, errors.New("Access denied")
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
 	}
 
 	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
@@ -0,0 +1,302 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/server"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+)
+
+const (
+	// ShadowDeltaMethod is the notification method sending the delta
+	// between the desired and the reported state to a device
+	ShadowDeltaMethod = "shadow_delta"
+	// ShadowUpdatedMethod is the notification method sent to the
+	// subscribers of a shadow when it changes
+	ShadowUpdatedMethod = "shadow_updated"
+)
+
+// ShadowParams is the format of the parameters of shadow_report,
+// shadow_desire and shadow_get. Device is the ULID of the device and is
+// not needed when the caller is the device itself.
+type ShadowParams struct {
+	Device string                 `json:"device"`
+	State  map[string]interface{} `json:"state"`
+}
+
+// Shadow is the stored state of a device
+type Shadow struct {
+	Device   string                 `json:"device"`
+	Version  int64                  `json:"version"`
+	Reported map[string]interface{} `json:"reported"`
+	Desired  map[string]interface{} `json:"desired"`
+	Delta    map[string]interface{} `json:"delta,omitempty"`
+}
+
+// ShadowTopic returns the topic of the updates of the shadow of a device
+func ShadowTopic(deviceULID string) string {
+	return "shadow." + deviceULID
+}
+
+// authorizeShadowTopic allows devices to subscribe to the updates of their
+// own shadow, and users to the shadows of the devices they can read.
+func authorizeShadowTopic(s *Session, topic string) bool {
+	ulid := strings.TrimPrefix(topic, "shadow.")
+	if ulid == topic || ulid == "" {
+		return false
+	}
+	if s.DeviceID != 0 && ulid == s.DeviceULID {
+		return true
+	}
+	if s.UID == 0 {
+		return false
+	}
+	var deviceID int64
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		deviceID = h.Device().Search(env, q.Device().Ulid().Equals(ulid)).ID()
+	})
+	return deviceID != 0 && canReadRecord(s.UID, "Device", deviceID)
+}
+
+// mergeState recursively merges patch into state. Null values in patch
+// remove the corresponding keys from state.
+func mergeState(state, patch map[string]interface{}) map[string]interface{} {
+	if state == nil {
+		state = make(map[string]interface{})
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(state, k)
+			continue
+		}
+		sub, isMap := v.(map[string]interface{})
+		current, currentIsMap := state[k].(map[string]interface{})
+		if isMap && currentIsMap {
+			state[k] = mergeState(current, sub)
+			continue
+		}
+		state[k] = v
+	}
+	return state
+}
+
+// shadowDelta returns the part of desired that differs from reported
+func shadowDelta(desired, reported map[string]interface{}) map[string]interface{} {
+	delta := make(map[string]interface{})
+	for k, v := range desired {
+		sub, isMap := v.(map[string]interface{})
+		current, currentIsMap := reported[k].(map[string]interface{})
+		if isMap && currentIsMap {
+			if d := shadowDelta(sub, current); len(d) > 0 {
+				delta[k] = d
+			}
+			continue
+		}
+		if !reflect.DeepEqual(v, reported[k]) {
+			delta[k] = v
+		}
+	}
+	return delta
+}
+
+// parseState returns the state stored in the given JSON text
+func parseState(text string) map[string]interface{} {
+	state := make(map[string]interface{})
+	if text != "" {
+		json.Unmarshal([]byte(text), &state)
+	}
+	return state
+}
+
+// readShadow returns the shadow of the given device
+func readShadow(device h.DeviceSet) *Shadow {
+	shadow := &Shadow{
+		Device:   device.Ulid(),
+		Version:  device.ShadowVersion(),
+		Reported: parseState(device.Reported()),
+		Desired:  parseState(device.Desired()),
+	}
+	shadow.Delta = shadowDelta(shadow.Desired, shadow.Reported)
+	return shadow
+}
+
+// updateShadow merges the given reported or desired state into the shadow
+// of the device with the given ID and returns the new shadow. The update
+// is made with the given uid so that users need write access to the device.
+func updateShadow(uid int64, deviceID int64, reported, desired map[string]interface{}) (*Shadow, error) {
+	var shadow *Shadow
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		env.Cr().Execute(fmt.Sprintf("SELECT id FROM %s WHERE id = ? FOR UPDATE", h.Device().TableName()), deviceID)
+		device := h.Device().Search(env, q.Device().ID().Equals(deviceID))
+		if device.IsEmpty() {
+			log.Panic("Device not found", "device", deviceID)
+		}
+		shadow = readShadow(device)
+		data := &h.DeviceData{ShadowVersion: shadow.Version + 1}
+		var fields []models.FieldNamer
+		if reported != nil {
+			shadow.Reported = mergeState(shadow.Reported, reported)
+			text, _ := json.Marshal(shadow.Reported)
+			data.Reported = string(text)
+			fields = append(fields, h.Device().Reported())
+		}
+		if desired != nil {
+			shadow.Desired = mergeState(shadow.Desired, desired)
+			text, _ := json.Marshal(shadow.Desired)
+			data.Desired = string(text)
+			fields = append(fields, h.Device().Desired())
+		}
+		device.Write(data, fields...)
+		shadow.Version = data.ShadowVersion
+		shadow.Delta = shadowDelta(shadow.Desired, shadow.Reported)
+	})
+	if err != nil {
+		return nil, err
+	}
+	PublishAll(ShadowUpdatedMethod, shadow, ShadowTopic(shadow.Device))
+	return shadow, nil
+}
+
+// pushShadowDelta sends the delta of the given shadow to the sessions of
+// the device, if it is not empty.
+func pushShadowDelta(deviceID int64, shadow *Shadow) {
+	if len(shadow.Delta) == 0 {
+		return
+	}
+	params := map[string]interface{}{
+		"version": shadow.Version,
+		"state":   shadow.Delta,
+	}
+	for _, session := range deviceSessions(deviceID) {
+		session.Notify(ShadowDeltaMethod, params)
+	}
+}
+
+// deviceShadowConnected sends the pending delta to a device that has
+// just logged in.
+func deviceShadowConnected(deviceID int64) {
+	var shadow *Shadow
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		device := h.Device().Search(env, q.Device().ID().Equals(deviceID))
+		if !device.IsEmpty() {
+			shadow = readShadow(device)
+		}
+	})
+	if shadow != nil {
+		pushShadowDelta(deviceID, shadow)
+	}
+}
+
+// sessionDeviceID returns the ID of the device targeted by a shadow request:
+// the device of the session, or the device with the given ULID if the
+// session is a user session.
+func sessionDeviceID(s *Session, ulid string) (int64, error) {
+	if s.DeviceID != 0 && (ulid == "" || ulid == s.DeviceULID) {
+		return s.DeviceID, nil
+	}
+	if s.UID == 0 {
+		return 0, errors.New("Access denied")
+	}
+	var deviceID int64
+	err := models.ExecuteInNewEnvironment(s.UID, func(env models.Environment) {
+		deviceID = h.Device().Search(env, q.Device().Ulid().Equals(ulid)).ID()
+	})
+	if err == nil && deviceID == 0 {
+		err = errors.New("Device not found: " + ulid)
+	}
+	return deviceID, err
+}
+
+// JsonRPCShadowReport updates the reported state of the device of the
+// session. It returns the new shadow, whose delta tells the device what
+// is left to apply.
+func JsonRPCShadowReport(s *Session, r *RequestRPC) (interface{}, error) {
+	if s.DeviceID == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, "Access denied", nil), nil
+	}
+	var params ShadowParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil || params.State == nil {
+		return NewResponseError(r, ErrorCodeInvalidParams, "JsonRPCShadowReport error: Invalid format", nil), nil
+	}
+	shadow, err := updateShadow(security.SuperUserID, s.DeviceID, params.State, nil)
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  shadow,
+	}, nil
+}
+
+// JsonRPCShadowDesire updates the desired state of a device and sends the
+// resulting delta to the device if it is online.
+func JsonRPCShadowDesire(s *Session, r *RequestRPC) (interface{}, error) {
+	uid := s.UID
+	if uid == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
+	}
+	var params ShadowParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil || params.State == nil {
+		return NewResponseError(r, ErrorCodeInvalidParams, "JsonRPCShadowDesire error: Invalid format", nil), nil
+	}
+	deviceID, err := sessionDeviceID(s, params.Device)
+	if err != nil {
+		return NewResponseError(r, ErrorCodeNotFound, err.Error(), nil), nil
+	}
+	shadow, err := updateShadow(uid, deviceID, nil, params.State)
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	pushShadowDelta(deviceID, shadow)
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  shadow,
+	}, nil
+}
+
+// JsonRPCShadowGet returns the shadow of a device
+func JsonRPCShadowGet(s *Session, r *RequestRPC) (interface{}, error) {
+	var params ShadowParams
+	if r.Params != nil {
+		json.Unmarshal(*r.Params, &params)
+	}
+	deviceID, err := sessionDeviceID(s, params.Device)
+	if err != nil {
+		return NewResponseError(r, ErrorCodeNotFound, err.Error(), nil), nil
+	}
+	var shadow *Shadow
+	err = models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		shadow = readShadow(h.Device().Search(env, q.Device().ID().Equals(deviceID)))
+	})
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  shadow,
+	}, nil
+}
+
+func init() {
+	RegisterTopic("shadow", authorizeShadowTopic)
+
+	h.Device().AddFields(map[string]models.FieldDefinition{
+		"Reported": models.TextField{String: "Reported State", NoCopy: true,
+			Help: "JSON state last reported by the device"},
+		"Desired": models.TextField{String: "Desired State", NoCopy: true,
+			Help: "JSON state the device should apply"},
+		"ShadowVersion": models.IntegerField{String: "Shadow Version", GoType: new(int64), NoCopy: true},
+	})
+}
@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// decodeState returns the given JSON object
+func decodeState(t *testing.T, text string) map[string]interface{} {
+	t.Helper()
+	if text == "" {
+		return nil
+	}
+	var state map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestMergeState(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string
+		patch string
+		want  string
+	}{
+		{"nil state", ``, `{"a": 1}`, `{"a": 1}`},
+		{"add and replace", `{"a": 1, "b": 2}`, `{"b": 3, "c": 4}`, `{"a": 1, "b": 3, "c": 4}`},
+		{"null removes", `{"a": 1, "b": 2}`, `{"a": null}`, `{"b": 2}`},
+		{"nested merge", `{"led": {"on": true, "color": "red"}}`, `{"led": {"color": "blue"}}`,
+			`{"led": {"on": true, "color": "blue"}}`},
+		{"nested null", `{"led": {"on": true, "color": "red"}}`, `{"led": {"color": null}}`, `{"led": {"on": true}}`},
+		{"object replaces value", `{"led": true}`, `{"led": {"on": true}}`, `{"led": {"on": true}}`},
+		{"value replaces object", `{"led": {"on": true}}`, `{"led": false}`, `{"led": false}`},
+		{"arrays are replaced", `{"a": [1, 2]}`, `{"a": [3]}`, `{"a": [3]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeState(decodeState(t, tt.state), decodeState(t, tt.patch))
+			if want := decodeState(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("mergeState() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestShadowDelta(t *testing.T) {
+	tests := []struct {
+		name     string
+		desired  string
+		reported string
+		want     string
+	}{
+		{"in sync", `{"a": 1, "b": {"c": 2}}`, `{"a": 1, "b": {"c": 2}, "d": 3}`, `{}`},
+		{"changed value", `{"a": 1, "b": 2}`, `{"a": 1, "b": 3}`, `{"b": 2}`},
+		{"missing value", `{"a": 1}`, `{}`, `{"a": 1}`},
+		{"nested difference", `{"led": {"on": true, "color": "red"}}`, `{"led": {"on": true, "color": "blue"}}`,
+			`{"led": {"color": "red"}}`},
+		{"object against value", `{"led": {"on": true}}`, `{"led": false}`, `{"led": {"on": true}}`},
+		{"arrays", `{"a": [1, 2]}`, `{"a": [1, 2]}`, `{}`},
+		{"nothing desired", `{}`, `{"a": 1}`, `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := shadowDelta(decodeState(t, tt.desired), decodeState(t, tt.reported))
+			if want := decodeState(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("shadowDelta() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeShadowTopicDevice(t *testing.T) {
+	device := &Session{DeviceID: 4, DeviceULID: "01ARZ3NDEKTSV4RRFFQ69G5FAV"}
+	tests := []struct {
+		name    string
+		session *Session
+		topic   string
+		want    bool
+	}{
+		{"own shadow", device, ShadowTopic(device.DeviceULID), true},
+		{"other shadow", device, ShadowTopic("01BX5ZZKBKACTAV9WEVGEMMVRZ"), false},
+		{"empty ulid", device, "shadow.", false},
+		{"other prefix", device, "record." + device.DeviceULID, false},
+		{"anonymous", &Session{}, ShadowTopic(device.DeviceULID), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := authorizeShadowTopic(tt.session, tt.topic); got != tt.want {
+				t.Errorf("authorizeShadowTopic(%q) = %v, want %v", tt.topic, got, tt.want)
+			}
+		})
+	}
+}
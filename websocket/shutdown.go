@@ -0,0 +1,245 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/oklog/ulid"
+	"github.com/spf13/viper"
+)
+
+const (
+	// ShutdownMethod is the method of the notification sent to the clients
+	// when the server shuts down
+	ShutdownMethod = "server_shutdown"
+	// DefaultShutdownTimeout is the default time given to the services to
+	// drain their connections when the server is stopped
+	DefaultShutdownTimeout = 30 * time.Second
+	// shutdownPollInterval is the period of the checks of the remaining
+	// sessions while a service shuts down
+	shutdownPollInterval = 100 * time.Millisecond
+)
+
+// ErrServiceClosed is returned for the requests received by a service that
+// is shutting down
+var ErrServiceClosed = errors.New("service is shutting down")
+
+// ServerShutdown is the params of the server_shutdown notification. Clients
+// should reconnect after ReconnectAfter milliseconds, which are spread over
+// the ReconnectJitter of the service so that they do not all come back at
+// the same time.
+type ServerShutdown struct {
+	Epoch          int64 `json:"epoch"`
+	ReconnectAfter int64 `json:"reconnect_after"`
+}
+
+// HandleRequest upgrades the given HTTP request to a websocket connection,
+// unless the service is shutting down. The subprotocol of the connection,
+// which selects its codec, is negotiated first.
+func (service *Service) HandleRequest(w http.ResponseWriter, r *http.Request) error {
+	if service.Closing() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(service.Settings.ReconnectJitter/time.Second)+1))
+		http.Error(w, ErrServiceClosed.Error(), http.StatusServiceUnavailable)
+		return ErrServiceClosed
+	}
+	proto := negotiateSubProtocol(service.Upgrader.Subprotocols, r)
+	return service.Melody.HandleRequestWithKeys(w, r, map[string]interface{}{subProtocolKey: proto})
+}
+
+// Closing returns true if the service is shutting down
+func (service *Service) Closing() bool {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	return service.closing
+}
+
+// beginHandler registers a message handler in flight. It returns false if
+// the service is shutting down, in which case the message must be dropped.
+func (service *Service) beginHandler() bool {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	if service.closing {
+		return false
+	}
+	service.inflight.Add(1)
+	return true
+}
+
+// endHandler unregisters a message handler in flight
+func (service *Service) endHandler() {
+	service.inflight.Done()
+}
+
+// Shutdown stops the service. It refuses new connections, notifies the
+// clients with server_shutdown, waits for the handlers in flight, closes the
+// connections with the "going away" close code and writes the pending
+// connection and log records. It returns the error of ctx if it is done
+// before all the connections are closed.
+func (service *Service) Shutdown(ctx context.Context) error {
+	service.mutex.Lock()
+	if service.closing {
+		service.mutex.Unlock()
+		return ErrServiceClosed
+	}
+	service.closing = true
+	service.mutex.Unlock()
+	log.Info(fmt.Sprintf("%s: Shutting down", service.Name))
+
+	service.notifyShutdown()
+	err := service.waitHandlers(ctx)
+
+	if bridge != nil && bridge.service == service {
+		bridge.stop()
+	}
+	service.Sessions.Range(func(key, value interface{}) bool {
+		if session, ok := value.(*Session); ok && session.transport != nil {
+			session.Close()
+		}
+		return true
+	})
+	service.CloseWithMsg(websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"))
+	if waitErr := service.waitSessions(ctx); err == nil {
+		err = waitErr
+	}
+	// Record the disconnection of the sessions whose disconnect handler did
+	// not run in time
+	service.Sessions.Range(func(key, value interface{}) bool {
+		if session, ok := value.(*Session); ok {
+			service.removeSession(session)
+		}
+		return true
+	})
+
+	close(service.done)
+	Services.Delete(service.Name)
+	activityWriter().Flush()
+	messageLogWriter().Flush()
+	if telemetryWriter != nil {
+		telemetryWriter.Flush()
+	}
+	log.Info(fmt.Sprintf("%s: Stopped", service.Name))
+	return err
+}
+
+// notifyShutdown sends the server_shutdown notification to all the clients
+// of the service
+func (service *Service) notifyShutdown() {
+	jitter := int64(service.Settings.ReconnectJitter / time.Millisecond)
+	service.Sessions.Range(func(key, value interface{}) bool {
+		session, ok := value.(*Session)
+		if !ok {
+			return true
+		}
+		params := &ServerShutdown{Epoch: int64(ulid.Now())}
+		if jitter > 0 {
+			params.ReconnectAfter = rand.Int63n(jitter)
+		}
+		session.Notify(ShutdownMethod, params)
+		return true
+	})
+}
+
+// waitHandlers waits for the message handlers in flight
+func (service *Service) waitHandlers(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		service.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitSessions waits until the disconnection of all the sessions has been
+// handled
+func (service *Service) waitSessions(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		empty := true
+		service.Sessions.Range(func(key, value interface{}) bool {
+			empty = false
+			return false
+		})
+		if empty {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ShutdownTimeout returns the time given to the services to drain their
+// connections, read from the Websocket.ShutdownTimeout setting.
+func ShutdownTimeout() time.Duration {
+	if viper.IsSet("Websocket.ShutdownTimeout") {
+		return viper.GetDuration("Websocket.ShutdownTimeout")
+	}
+	return DefaultShutdownTimeout
+}
+
+// ShutdownAll shuts down all the services, then writes the pending records
+// and closes the session store. The module does not handle signals itself:
+// the server stops the services with ShutdownServer, or calls ShutdownAll
+// when it stops before closing the database. The services refuse new
+// connections and messages as soon as it is called.
+func ShutdownAll(ctx context.Context) error {
+	var services []*Service
+	Services.Range(func(key, value interface{}) bool {
+		services = append(services, value.(*Service))
+		return true
+	})
+	errs := make(chan error, len(services))
+	for _, service := range services {
+		go func(service *Service) {
+			errs <- service.Shutdown(ctx)
+		}(service)
+	}
+	var err error
+	for range services {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	activityWriter().Close()
+	messageLogWriter().Close()
+	if telemetryWriter != nil {
+		telemetryWriter.Close()
+	}
+	writeRateLimitStats(time.Now())
+	Store().Close()
+	return err
+}
+
+// ShutdownServer gracefully stops srv, the HTTP server serving the
+// websocket services, within ShutdownTimeout. It is the call to make
+// instead of srv.Shutdown in the stop path of the server, e.g.
+//
+//	<-stop
+//	websocket.ShutdownServer(srv)
+//
+// The services are shut down first, since the websocket connections are
+// hijacked and srv.Shutdown does not wait for them. Upgrade requests
+// received meanwhile are refused with 503 Service Unavailable.
+func ShutdownServer(srv *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout())
+	defer cancel()
+	err := ShutdownAll(ctx)
+	if srvErr := srv.Shutdown(ctx); err == nil {
+		err = srvErr
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShutdownServer(t *testing.T) {
+	service, err := NewServiceWithConfig("shutdown_test", &ServiceConfig{})
+	if err != nil {
+		t.Fatalf("NewServiceWithConfig() error = %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service.HandleRequest(w, r)
+	}))
+	defer server.Close()
+
+	if err := ShutdownServer(server.Config); err != nil {
+		t.Fatalf("ShutdownServer() error = %v", err)
+	}
+	if !service.Closing() {
+		t.Error("service is not closing after ShutdownServer()")
+	}
+	select {
+	case <-service.done:
+	default:
+		t.Error("service is not stopped after ShutdownServer()")
+	}
+	if _, ok := Services.Load(service.Name); ok {
+		t.Error("service is still registered after ShutdownServer()")
+	}
+	if resp, err := http.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Error("HTTP server still accepts requests after ShutdownServer()")
+	}
+}
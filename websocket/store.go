@@ -0,0 +1,566 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/spf13/viper"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/server"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+)
+
+const (
+	// StoreChannel is the PostgreSQL notification channel of the messages
+	// exchanged between server instances
+	StoreChannel = "hexya_websocket"
+	// storeMaxPayload is the maximum size of a PostgreSQL notification.
+	// Larger messages are stored in JsonServiceStoreMessage and notified
+	// by reference.
+	storeMaxPayload = 7999
+	// storeMessageRetention is the time the large messages are kept for
+	// the other server instances to read them
+	storeMessageRetention = 5 * time.Minute
+	// NodeHeartbeatInterval is the interval between the updates of the
+	// liveness of a server instance in JsonServiceNode
+	NodeHeartbeatInterval = 30 * time.Second
+	// NodeExpiry is the time after its last heartbeat a server instance
+	// is considered down. The connections of a server instance that is
+	// down are not counted in the presence of users.
+	NodeExpiry = 3 * NodeHeartbeatInterval
+)
+
+// Kinds of the messages exchanged between server instances
+const (
+	// StorePublish notifies the sessions subscribed to one of the topics
+	StorePublish = "publish"
+	// StoreUser notifies all the sessions of a user
+	StoreUser = "user"
+	// StoreSession notifies a session
+	StoreSession = "session"
+	// StoreAction runs a back-office action on a session
+	StoreAction = "action"
+)
+
+// A StoreMessage is a message delivered to the sessions of all the server
+// instances. Service restricts the delivery to the sessions of a service.
+type StoreMessage struct {
+	Node    string          `json:"node"`
+	Kind    string          `json:"kind"`
+	Service string          `json:"service,omitempty"`
+	Topics  []string        `json:"topics,omitempty"`
+	UID     int64           `json:"uid,omitempty"`
+	SID     string          `json:"sid,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	// Ref is the ID of the JsonServiceStoreMessage holding a message too
+	// large for a notification. The other members are then empty.
+	Ref int64 `json:"ref,omitempty"`
+}
+
+// SessionPresence describes a session connected to a server instance
+type SessionPresence struct {
+	Node            string `db:"node" json:"node"`
+	Service         string `db:"service" json:"service"`
+	SID             string `db:"session" json:"sid"`
+	UID             int64  `db:"uid" json:"uid,omitempty"`
+	Device          string `db:"device" json:"device,omitempty"`
+	ConnectedEpoch  int64  `db:"connected_epoch" json:"connected_epoch"`
+	LastActiveEpoch int64  `db:"last_active_epoch" json:"last_active_epoch"`
+}
+
+// A SessionStore shares the sessions of the services between the server
+// instances of a deployment.
+type SessionStore interface {
+	// Broadcast delivers msg to the sessions of all the server instances,
+	// including this one
+	Broadcast(msg *StoreMessage) error
+	// UserSessions returns the sessions of the given user on all the
+	// server instances. The caller must check that the presence of the
+	// user may be disclosed (see canSeePresence).
+	UserSessions(uid int64) ([]SessionPresence, error)
+	// Close releases the resources of the store
+	Close() error
+}
+
+// NodeName identifies this server instance. It is read from the
+// Websocket.Node setting when the server starts and defaults to the host
+// name. Instances sharing a database must have different names.
+var NodeName string
+
+var (
+	store      SessionStore = MemoryStore{}
+	storeMutex sync.RWMutex
+)
+
+// nodeName returns the name of this server instance
+func nodeName() string {
+	if name := viper.GetString("Websocket.Node"); name != "" {
+		return name
+	}
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return NewULID()
+}
+
+// Store returns the session store of the server
+func Store() SessionStore {
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	return store
+}
+
+// SetStore replaces the session store of the server. The previous store is
+// closed.
+func SetStore(s SessionStore) {
+	storeMutex.Lock()
+	previous := store
+	store = s
+	storeMutex.Unlock()
+	if previous != nil && previous != s {
+		previous.Close()
+	}
+}
+
+// broadcast delivers a message through the session store. The message is
+// delivered to the sessions of this server if the store fails.
+func broadcast(msg *StoreMessage) {
+	msg.Node = NodeName
+	if err := Store().Broadcast(msg); err != nil {
+		log.Warn("Unable to broadcast message", "kind", msg.Kind, "method", msg.Method, "error", err)
+		deliver(msg)
+	}
+}
+
+// newStoreMessage returns a message of the given kind with the JSON
+// encoding of params
+func newStoreMessage(kind, method string, params interface{}) (*StoreMessage, error) {
+	msg := &StoreMessage{Kind: kind, Method: method}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		msg.Params = data
+	}
+	return msg, nil
+}
+
+// PushUser sends a notification to all the sessions of the given user, on
+// all the server instances
+func PushUser(uid int64, method string, params interface{}) error {
+	msg, err := newStoreMessage(StoreUser, method, params)
+	if err != nil {
+		return err
+	}
+	msg.UID = uid
+	broadcast(msg)
+	return nil
+}
+
+// PushSession sends a notification to the session with the given SID of
+// the given service, on whatever server instance it is connected
+func PushSession(service, sid string, method string, params interface{}) error {
+	msg, err := newStoreMessage(StoreSession, method, params)
+	if err != nil {
+		return err
+	}
+	msg.Service = service
+	msg.SID = sid
+	broadcast(msg)
+	return nil
+}
+
+// UserPresence returns the sessions of the given user on all the server
+// instances. It does not check access rights.
+func UserPresence(uid int64) ([]SessionPresence, error) {
+	return Store().UserSessions(uid)
+}
+
+// localSessions calls fn with the sessions of this server that msg is for,
+// including the detached sessions that can be resumed.
+func localSessions(msg *StoreMessage, fn func(*Session)) {
+	Services.Range(func(key, value interface{}) bool {
+		service := value.(*Service)
+		if msg.Service != "" && msg.Service != service.Name {
+			return true
+		}
+		service.Sessions.Range(func(k, v interface{}) bool {
+			if session, ok := v.(*Session); ok {
+				fn(session)
+			}
+			return true
+		})
+		for _, session := range service.detachedSessions() {
+			fn(session)
+		}
+		return true
+	})
+}
+
+// deliver delivers a message to the sessions of this server
+func deliver(msg *StoreMessage) {
+	var params interface{}
+	if len(msg.Params) > 0 {
+		params = msg.Params
+	}
+	switch msg.Kind {
+	case StorePublish:
+		localSessions(msg, func(s *Session) {
+			s.publish(msg.Method, params, msg.Topics)
+		})
+	case StoreUser:
+		localSessions(msg, func(s *Session) {
+			if s.UID == msg.UID {
+				s.Notify(msg.Method, params)
+			}
+		})
+	case StoreSession:
+		localSessions(msg, func(s *Session) {
+			if s.SID == msg.SID {
+				s.Notify(msg.Method, params)
+			}
+		})
+	case StoreAction:
+		if session := liveSession(msg.Service, msg.SID); session != nil {
+			sessionAction(session, msg.Method)
+		}
+	default:
+		log.Info("Unknown store message", "kind", msg.Kind, "node", msg.Node)
+	}
+}
+
+// MemoryStore is the session store of a single server instance
+type MemoryStore struct{}
+
+// Broadcast delivers msg to the sessions of this server
+func (MemoryStore) Broadcast(msg *StoreMessage) error {
+	deliver(msg)
+	return nil
+}
+
+// UserSessions returns the sessions of the given user on this server
+func (MemoryStore) UserSessions(uid int64) ([]SessionPresence, error) {
+	var res []SessionPresence
+	localSessions(&StoreMessage{}, func(s *Session) {
+		s.mutex.Lock()
+		removed := s.removed
+		s.mutex.Unlock()
+		if s.UID != uid || removed {
+			return
+		}
+		res = append(res, SessionPresence{
+			Node:            NodeName,
+			Service:         s.Service.Name,
+			SID:             s.SID,
+			UID:             s.UID,
+			Device:          s.DeviceULID,
+			LastActiveEpoch: s.lastActive(),
+		})
+	})
+	return res, nil
+}
+
+// Close does nothing
+func (MemoryStore) Close() error {
+	return nil
+}
+
+// PostgresStore is a session store shared by the server instances using
+// the Hexya database. Messages are exchanged with NOTIFY on StoreChannel
+// and the presence of sessions is read from JsonServiceConnection.
+type PostgresStore struct {
+	listener *pq.Listener
+	done     chan struct{}
+}
+
+// postgresConnString returns the connection string of the Hexya database
+func postgresConnString() string {
+	params := []struct{ key, setting string }{
+		{"host", "DB.Host"},
+		{"port", "DB.Port"},
+		{"user", "DB.User"},
+		{"password", "DB.Password"},
+		{"dbname", "DB.Name"},
+		{"sslmode", "DB.SSLMode"},
+		{"sslcert", "DB.SSLCert"},
+		{"sslkey", "DB.SSLKey"},
+		{"sslrootcert", "DB.SSLCA"},
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	var res []string
+	for _, p := range params {
+		if value := viper.GetString(p.setting); value != "" {
+			res = append(res, fmt.Sprintf("%s='%s'", p.key, escape.Replace(value)))
+		}
+	}
+	return strings.Join(res, " ")
+}
+
+// NewPostgresStore returns a session store listening to the notifications
+// of the other server instances
+func NewPostgresStore() (*PostgresStore, error) {
+	listener := pq.NewListener(postgresConnString(), 10*time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Warn("Session store listener error", "event", event, "error", err)
+			}
+		})
+	if err := listener.Listen(StoreChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	ps := &PostgresStore{listener: listener, done: make(chan struct{})}
+	ps.beat(time.Now())
+	go ps.listen()
+	return ps, nil
+}
+
+// beat records that this server instance is alive until NodeExpiry from
+// now, and purges the large messages the other instances have had time
+// to read
+func (ps *PostgresStore) beat(now time.Time) {
+	expires := now.Add(NodeExpiry).UnixNano() / int64(time.Millisecond)
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		table := h.JsonServiceNode().TableName()
+		env.Cr().Execute(fmt.Sprintf(`INSERT INTO %s (name, expires_epoch,
+			create_date, write_date, hexya_external_id, hexya_version)
+			VALUES (?, ?, now(), now(), md5(random()::text || clock_timestamp()::text), 0)
+			ON CONFLICT (name) DO UPDATE SET expires_epoch = EXCLUDED.expires_epoch, write_date = now()`,
+			table), NodeName, expires)
+		env.Cr().Execute(fmt.Sprintf("DELETE FROM %s WHERE create_date < ?",
+			h.JsonServiceStoreMessage().TableName()), now.Add(-storeMessageRetention).UTC())
+	})
+	if err != nil {
+		log.Warn("Unable to record server instance heartbeat", "node", NodeName, "error", err)
+	}
+}
+
+// storedMessage returns the message stored in JsonServiceStoreMessage with
+// the given ID
+func storedMessage(ref int64) (*StoreMessage, error) {
+	var payload string
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		payload = h.JsonServiceStoreMessage().Search(env, q.JsonServiceStoreMessage().ID().Equals(ref)).Payload()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if payload == "" {
+		return nil, fmt.Errorf("stored message %d not found", ref)
+	}
+	var msg StoreMessage
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// listen delivers the messages of the other server instances
+func (ps *PostgresStore) listen() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(NodeHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case notification := <-ps.listener.Notify:
+			if notification == nil {
+				// Reconnected: notifications may have been lost
+				continue
+			}
+			var msg StoreMessage
+			if err := json.Unmarshal([]byte(notification.Extra), &msg); err != nil {
+				log.Info("Invalid store message", "error", err)
+				continue
+			}
+			if msg.Node == NodeName {
+				continue
+			}
+			if msg.Ref != 0 {
+				stored, err := storedMessage(msg.Ref)
+				if err != nil {
+					log.Warn("Unable to read store message", "ref", msg.Ref, "node", msg.Node, "error", err)
+					continue
+				}
+				msg = *stored
+			}
+			deliver(&msg)
+		case <-ticker.C:
+			go ps.listener.Ping()
+		case now := <-heartbeat.C:
+			go ps.beat(now)
+		case <-ps.done:
+			return
+		}
+	}
+}
+
+// Broadcast delivers msg to the sessions of this server and notifies the
+// other server instances. Messages too large for a notification are stored
+// in JsonServiceStoreMessage and their ID is notified instead.
+func (ps *PostgresStore) Broadcast(msg *StoreMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	err = models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		if len(payload) > storeMaxPayload {
+			stored := h.JsonServiceStoreMessage().Create(env, &h.JsonServiceStoreMessageData{Payload: string(payload)})
+			ref, err := json.Marshal(&StoreMessage{Node: msg.Node, Kind: msg.Kind, Ref: stored.ID()})
+			if err != nil {
+				log.Panic("Unable to encode store message reference", "error", err)
+			}
+			payload = ref
+		}
+		// The notification is sent when the stored message is committed
+		env.Cr().Execute("SELECT pg_notify(?, ?)", StoreChannel, string(payload))
+	})
+	if err != nil {
+		return err
+	}
+	deliver(msg)
+	return nil
+}
+
+// UserSessions returns the online connections of the given user on this
+// server instance and on the instances that are alive. The connections left
+// online by an instance that is down are ignored.
+func (ps *PostgresStore) UserSessions(uid int64) ([]SessionPresence, error) {
+	var res []SessionPresence
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		env.Cr().Select(&res, fmt.Sprintf(`SELECT COALESCE(c.node, '') AS node, c.service,
+			c.session, c.user_id AS uid, COALESCE(d.ulid, '') AS device,
+			COALESCE(c.connected_epoch, 0) AS connected_epoch,
+			COALESCE(c.last_active_epoch, 0) AS last_active_epoch
+			FROM %s c LEFT JOIN %s d ON d.id = c.device_id
+			WHERE c.user_id = ? AND c.offline IS NOT true
+			AND (c.node = ? OR EXISTS (SELECT 1 FROM %s n WHERE n.name = c.node AND n.expires_epoch > ?))
+			ORDER BY c.id`,
+			h.JsonServiceConnection().TableName(), h.Device().TableName(), h.JsonServiceNode().TableName()),
+			uid, NodeName, now)
+	})
+	return res, err
+}
+
+// Close stops listening to the other server instances and records that
+// this instance is down
+func (ps *PostgresStore) Close() error {
+	close(ps.done)
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		env.Cr().Execute(fmt.Sprintf("UPDATE %s SET expires_epoch = 0 WHERE name = ?",
+			h.JsonServiceNode().TableName()), NodeName)
+	})
+	if err != nil {
+		log.Warn("Unable to record server instance shutdown", "node", NodeName, "error", err)
+	}
+	return ps.listener.Close()
+}
+
+// startSessionStore sets the name of this server instance and the session
+// store selected by the Websocket.SessionStore setting: "memory" (default)
+// or "postgres".
+func startSessionStore() {
+	NodeName = nodeName()
+	switch kind := viper.GetString("Websocket.SessionStore"); kind {
+	case "", "memory":
+	case "postgres":
+		ps, err := NewPostgresStore()
+		if err != nil {
+			log.Warn("Unable to start the PostgreSQL session store", "error", err)
+			return
+		}
+		SetStore(ps)
+	default:
+		log.Warn("Unknown session store", "store", kind)
+	}
+}
+
+func init() {
+	nodeModel := h.JsonServiceNode().DeclareModel()
+	nodeModel.AddFields(map[string]models.FieldDefinition{
+		"Name": models.CharField{String: "Node", Required: true, Help: "Name of the server instance"},
+		"ExpiresEpoch": models.IntegerField{String: "Expires", GoType: new(int64),
+			Help: "Time after which the server instance is considered down, unless it records a new heartbeat"},
+	})
+	nodeModel.AddSQLConstraint("name_unique", "unique(name)", "Server instance names must be unique")
+
+	storeMessageModel := h.JsonServiceStoreMessage().DeclareModel()
+	storeMessageModel.AddFields(map[string]models.FieldDefinition{
+		"Payload": models.TextField{String: "Payload", Help: "Message too large for a database notification"},
+	})
+}
+
+// PresenceParams is the format of the parameters of presence
+type PresenceParams struct {
+	UIDs []int64 `json:"uids"`
+}
+
+// Presence is the presence of a user in the result of presence. The IDs
+// of the sessions are not given since they allow to resume them.
+type Presence struct {
+	UID             int64 `json:"uid"`
+	Online          bool  `json:"online"`
+	Sessions        int   `json:"sessions"`
+	LastActiveEpoch int64 `json:"last_active_epoch,omitempty"`
+}
+
+// canSeePresence returns true if the user of the session may know whether
+// the user with the given ID is online: users see their own presence, and
+// the users who can read the connections see everyone's.
+func canSeePresence(s *Session, uid int64) bool {
+	return s.UID != 0 && (uid == s.UID || canReadModel(s.UID, "JsonServiceConnection"))
+}
+
+// JsonRPCPresence returns the presence of the given users on all the server
+// instances, or of the user of the session if no user is given. Users who
+// cannot read the connections may only ask for their own presence.
+func JsonRPCPresence(s *Session, r *RequestRPC) (interface{}, error) {
+	if s.UID == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, "Access denied", nil), nil
+	}
+	var params PresenceParams
+	if r.Params != nil {
+		if err := json.Unmarshal(*r.Params, &params); err != nil {
+			return NewResponseError(r, ErrorCodeInvalidParams, "Invalid presence parameters", nil), nil
+		}
+	}
+	if len(params.UIDs) == 0 {
+		params.UIDs = []int64{s.UID}
+	}
+	for _, uid := range params.UIDs {
+		if !canSeePresence(s, uid) {
+			return NewResponseError(r, ErrorCodeAccessDenied, "Access denied", nil), nil
+		}
+	}
+	res := make([]Presence, 0, len(params.UIDs))
+	for _, uid := range params.UIDs {
+		sessions, err := UserPresence(uid)
+		if err != nil {
+			return NewExecutionError(s, r, err), nil
+		}
+		presence := Presence{UID: uid, Online: len(sessions) > 0, Sessions: len(sessions)}
+		for _, session := range sessions {
+			if session.LastActiveEpoch > presence.LastActiveEpoch {
+				presence.LastActiveEpoch = session.LastActiveEpoch
+			}
+		}
+		res = append(res, presence)
+	}
+	response := &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  res,
+	}
+	return response, nil
+}
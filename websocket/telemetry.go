@@ -0,0 +1,426 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/server"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+)
+
+const (
+	// TelemetryBatchSize is the number of readings written in one query
+	TelemetryBatchSize = 500
+	// TelemetryFlushInterval is the maximum time a reading stays buffered
+	TelemetryFlushInterval = 2 * time.Second
+	// TelemetrySchemaTTL is the time the telemetry schemas stay cached
+	TelemetrySchemaTTL = time.Minute
+	// TelemetryQueryLimit is the maximum number of rows returned by
+	// telemetry_query
+	TelemetryQueryLimit = 10000
+	// TelemetryAggregateInterval is the period of the computation of the
+	// aggregates of the hours and days that received readings
+	TelemetryAggregateInterval = 5 * time.Minute
+	// TelemetryMaxClockSkew is how far in the future the time of a reading
+	// may be
+	TelemetryMaxClockSkew = time.Minute
+)
+
+// A TelemetryReading is a single measurement sent by a device. Time is the
+// measurement time in milliseconds since the Unix epoch. It is required.
+type TelemetryReading struct {
+	Metric string  `json:"metric"`
+	Value  float64 `json:"value"`
+	Time   int64   `json:"time"`
+}
+
+// TelemetryParams is the format of the parameters of telemetry
+type TelemetryParams struct {
+	Readings []TelemetryReading `json:"readings"`
+}
+
+// TelemetryResult is the result of telemetry when sent as a request
+type TelemetryResult struct {
+	Accepted int      `json:"accepted"`
+	Rejected []string `json:"rejected,omitempty"`
+}
+
+// TelemetryQueryParams is the format of the parameters of telemetry_query.
+// From and To are in milliseconds since the Unix epoch. Period is empty for
+// raw readings, or "hour" or "day" for aggregates.
+type TelemetryQueryParams struct {
+	Device string `json:"device"`
+	Metric string `json:"metric"`
+	From   int64  `json:"from"`
+	To     int64  `json:"to"`
+	Period string `json:"period"`
+	Limit  int    `json:"limit"`
+}
+
+// TelemetryPoint is a raw reading or an aggregate returned by telemetry_query
+type TelemetryPoint struct {
+	Time  time.Time `db:"time" json:"-"`
+	Epoch int64     `db:"-" json:"time"`
+	Value float64   `db:"value" json:"value"`
+	Count int64     `db:"count" json:"count,omitempty"`
+	Min   float64   `db:"min" json:"min,omitempty"`
+	Max   float64   `db:"max" json:"max,omitempty"`
+}
+
+// telemetryRow is a reading waiting to be written
+type telemetryRow struct {
+	deviceID int64
+	metric   string
+	value    float64
+	time     time.Time
+}
+
+// telemetryBound holds the accepted range of values of a metric
+type telemetryBound struct {
+	min, max float64
+}
+
+// telemetrySchema holds the metrics accepted from a device type
+type telemetrySchema struct {
+	metrics map[string]telemetryBound
+	loaded  time.Time
+}
+
+// A telemetryWindow is a period whose aggregates are computed
+type telemetryWindow struct {
+	period     string
+	start, end time.Time
+}
+
+var (
+	telemetryWriter  *batchWriter
+	telemetrySchemas sync.Map
+	// telemetryHours are the start times of the hours that received
+	// readings since their aggregates were last computed
+	telemetryHours      = make(map[time.Time]bool)
+	telemetryHoursMutex sync.Mutex
+)
+
+// epochTime returns the time of the given number of milliseconds since the
+// Unix epoch, or the current time if ms is 0.
+func epochTime(ms int64) time.Time {
+	if ms == 0 {
+		return time.Now().UTC()
+	}
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC()
+}
+
+// getTelemetrySchema returns the telemetry schema of the given device type.
+// A device type without schema accepts all metrics.
+func getTelemetrySchema(deviceType string) *telemetrySchema {
+	if cached, ok := telemetrySchemas.Load(deviceType); ok {
+		schema := cached.(*telemetrySchema)
+		if time.Since(schema.loaded) < TelemetrySchemaTTL {
+			return schema
+		}
+	}
+	schema := &telemetrySchema{loaded: time.Now()}
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		entries := h.TelemetrySchema().Search(env, q.TelemetrySchema().DeviceType().Equals(deviceType))
+		if entries.IsEmpty() {
+			return
+		}
+		schema.metrics = make(map[string]telemetryBound)
+		for _, entry := range entries.Records() {
+			schema.metrics[entry.Metric()] = telemetryBound{min: entry.Min(), max: entry.Max()}
+		}
+	})
+	telemetrySchemas.Store(deviceType, schema)
+	return schema
+}
+
+// validate returns an error if the reading does not match the schema or if
+// its time is missing or later than now
+func (ts *telemetrySchema) validate(reading *TelemetryReading, now time.Time) error {
+	if reading.Metric == "" {
+		return errors.New("empty metric")
+	}
+	if reading.Time <= 0 {
+		return fmt.Errorf("%s: missing time", reading.Metric)
+	}
+	if epochTime(reading.Time).After(now.Add(TelemetryMaxClockSkew)) {
+		return fmt.Errorf("%s: time %d is in the future", reading.Metric, reading.Time)
+	}
+	if ts.metrics == nil {
+		return nil
+	}
+	bound, ok := ts.metrics[reading.Metric]
+	if !ok {
+		return fmt.Errorf("unknown metric %s", reading.Metric)
+	}
+	if bound.min < bound.max && (reading.Value < bound.min || reading.Value > bound.max) {
+		return fmt.Errorf("%s out of range: %v", reading.Metric, reading.Value)
+	}
+	return nil
+}
+
+// startTelemetry starts the telemetry writer and the aggregation job. The
+// previous hour and day are aggregated at startup, in case readings were
+// written before a restart.
+func startTelemetry() {
+	telemetryWriter = newBatchWriter(TelemetryBatchSize, TelemetryFlushInterval, writeTelemetry)
+	go func() {
+		now := time.Now().UTC()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		markTelemetryHours(now.Add(-time.Hour), today.Add(-time.Hour))
+		aggregateTelemetry()
+		ticker := time.NewTicker(TelemetryAggregateInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			aggregateTelemetry()
+		}
+	}()
+}
+
+// markTelemetryHours records that the hours of the given times received
+// readings
+func markTelemetryHours(times ...time.Time) {
+	telemetryHoursMutex.Lock()
+	defer telemetryHoursMutex.Unlock()
+	for _, t := range times {
+		telemetryHours[t.UTC().Truncate(time.Hour)] = true
+	}
+}
+
+// takeTelemetryHours returns and forgets the hours that received readings
+func takeTelemetryHours() []time.Time {
+	telemetryHoursMutex.Lock()
+	defer telemetryHoursMutex.Unlock()
+	hours := make([]time.Time, 0, len(telemetryHours))
+	for hour := range telemetryHours {
+		hours = append(hours, hour)
+	}
+	telemetryHours = make(map[time.Time]bool)
+	return hours
+}
+
+// telemetryWindows returns the hourly windows of the given hours and the
+// daily windows of their days, in chronological order
+func telemetryWindows(hours []time.Time) []telemetryWindow {
+	sort.Slice(hours, func(i, j int) bool { return hours[i].Before(hours[j]) })
+	var (
+		windows []telemetryWindow
+		days    []time.Time
+	)
+	for _, hour := range hours {
+		windows = append(windows, telemetryWindow{period: "hour", start: hour, end: hour.Add(time.Hour)})
+		day := time.Date(hour.Year(), hour.Month(), hour.Day(), 0, 0, 0, 0, time.UTC)
+		if len(days) == 0 || !days[len(days)-1].Equal(day) {
+			days = append(days, day)
+		}
+	}
+	for _, day := range days {
+		windows = append(windows, telemetryWindow{period: "day", start: day, end: day.AddDate(0, 0, 1)})
+	}
+	return windows
+}
+
+// writeTelemetry inserts the given telemetry rows with a single query
+// and records the hours they belong to for aggregation.
+func writeTelemetry(items []interface{}) {
+	times := make([]time.Time, len(items))
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		var (
+			values []string
+			args   []interface{}
+		)
+		now := time.Now().UTC()
+		for i, item := range items {
+			row := item.(*telemetryRow)
+			times[i] = row.time
+			values = append(values, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+			args = append(args, row.deviceID, row.metric, row.value, row.time,
+				now, now, security.SuperUserID, security.SuperUserID, NewULID(), 0)
+		}
+		query := fmt.Sprintf(`INSERT INTO %s (device_id, metric, value, time,
+			create_date, write_date, create_uid, write_uid, hexya_external_id, hexya_version)
+			VALUES %s`, h.Telemetry().TableName(), strings.Join(values, ", "))
+		env.Cr().Execute(query, args...)
+	})
+	if err != nil {
+		log.Warn("Unable to write telemetry", "readings", len(items), "error", err)
+		return
+	}
+	markTelemetryHours(times...)
+}
+
+// aggregateTelemetry computes again the hourly and daily aggregates of the
+// hours that received readings since the last call. The hours are kept for
+// the next call if the computation fails.
+func aggregateTelemetry() {
+	hours := takeTelemetryHours()
+	if len(hours) == 0 {
+		return
+	}
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		for _, window := range telemetryWindows(hours) {
+			env.Cr().Execute(fmt.Sprintf(`DELETE FROM %s WHERE period = ? AND start >= ? AND start < ?`,
+				h.TelemetryAggregate().TableName()), window.period, window.start, window.end)
+			env.Cr().Execute(fmt.Sprintf(`INSERT INTO %s (device_id, metric, period, start,
+				count, min, max, sum, avg, create_date, write_date, create_uid, write_uid,
+				hexya_external_id, hexya_version)
+				SELECT device_id, metric, ?, date_trunc(?, time),
+				count(*), min(value), max(value), sum(value), avg(value), now(), now(), ?, ?,
+				md5(random()::text || clock_timestamp()::text), 0
+				FROM %s WHERE time >= ? AND time < ?
+				GROUP BY device_id, metric, date_trunc(?, time)`,
+				h.TelemetryAggregate().TableName(), h.Telemetry().TableName()),
+				window.period, window.period, security.SuperUserID, security.SuperUserID,
+				window.start, window.end, window.period)
+		}
+	})
+	if err != nil {
+		markTelemetryHours(hours...)
+		log.Warn("Telemetry aggregation failed", "error", err)
+	}
+}
+
+// JsonRPCTelemetry receives readings from a device. It is usually sent as a
+// notification, in which case no answer is sent back.
+func JsonRPCTelemetry(s *Session, r *RequestRPC) (interface{}, error) {
+	if s.DeviceID == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, "Access denied", nil), nil
+	}
+	if r.Params == nil {
+		return NewResponseError(r, ErrorCodeInvalidParams, "JsonRPCTelemetry error: Missing readings", nil), nil
+	}
+	var params TelemetryParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return NewResponseError(r, ErrorCodeInvalidParams, "JsonRPCTelemetry error: Invalid format", nil), nil
+	}
+	schema := getTelemetrySchema(s.DeviceType)
+	now := time.Now()
+	var res TelemetryResult
+	for i := range params.Readings {
+		reading := &params.Readings[i]
+		if err := schema.validate(reading, now); err != nil {
+			res.Rejected = append(res.Rejected, err.Error())
+			continue
+		}
+		telemetryWriter.Add(&telemetryRow{
+			deviceID: s.DeviceID,
+			metric:   reading.Metric,
+			value:    reading.Value,
+			time:     epochTime(reading.Time),
+		})
+		res.Accepted++
+	}
+	if r.ID == 0 {
+		return nil, nil
+	}
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  &res,
+	}, nil
+}
+
+// JsonRPCTelemetryQuery returns the readings or the aggregates of a metric
+// of a device over a time range.
+func JsonRPCTelemetryQuery(s *Session, r *RequestRPC) (interface{}, error) {
+	uid := s.UID
+	if uid == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
+	}
+	var params TelemetryQueryParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return nil, errors.New("JsonRPCTelemetryQuery error: Invalid format")
+	}
+	if params.Limit <= 0 || params.Limit > TelemetryQueryLimit {
+		params.Limit = TelemetryQueryLimit
+	}
+	to := time.Now().UTC()
+	if params.To != 0 {
+		to = epochTime(params.To)
+	}
+	from := epochTime(params.From)
+	var points []TelemetryPoint
+	err = models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		device := h.Device().Search(env, q.Device().Ulid().Equals(params.Device))
+		if device.IsEmpty() {
+			log.Panic("Device not found", "device", params.Device)
+		}
+		switch params.Period {
+		case "":
+			env.Cr().Select(&points, fmt.Sprintf(`SELECT time, value FROM %s
+				WHERE device_id = ? AND metric = ? AND time >= ? AND time < ?
+				ORDER BY time LIMIT ?`, h.Telemetry().TableName()),
+				device.ID(), params.Metric, from, to, params.Limit)
+		case "hour", "day":
+			env.Cr().Select(&points, fmt.Sprintf(`SELECT start AS time, avg AS value, count, min, max FROM %s
+				WHERE device_id = ? AND metric = ? AND period = ? AND start >= ? AND start < ?
+				ORDER BY start LIMIT ?`, h.TelemetryAggregate().TableName()),
+				device.ID(), params.Metric, params.Period, from, to, params.Limit)
+		default:
+			log.Panic("Invalid period", "period", params.Period)
+		}
+	})
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	for i := range points {
+		points[i].Epoch = points[i].Time.UnixNano() / int64(time.Millisecond)
+	}
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  points,
+	}, nil
+}
+
+func init() {
+	schemaModel := h.TelemetrySchema().DeclareModel()
+	schemaModel.AddFields(map[string]models.FieldDefinition{
+		"DeviceType": models.CharField{String: "Device Type", Required: true, Index: true},
+		"Metric":     models.CharField{String: "Metric", Required: true},
+		"Unit":       models.CharField{String: "Unit"},
+		"Min": models.FloatField{String: "Minimum",
+			Help: "Readings below this value are rejected. Ignored unless less than Maximum"},
+		"Max": models.FloatField{String: "Maximum",
+			Help: "Readings above this value are rejected. Ignored unless greater than Minimum"},
+	})
+	schemaModel.AddSQLConstraint("device_type_metric_unique", "unique(device_type, metric)",
+		"A metric can only be defined once per device type")
+
+	telemetryModel := h.Telemetry().DeclareModel()
+	telemetryModel.AddFields(map[string]models.FieldDefinition{
+		"Device": models.Many2OneField{String: "Device", RelationModel: h.Device(),
+			Required: true, Index: true, OnDelete: models.Cascade},
+		"Metric": models.CharField{String: "Metric", Required: true, Index: true},
+		"Value":  models.FloatField{String: "Value"},
+		"Time":   models.DateTimeField{String: "Time", Required: true, Index: true},
+	})
+	telemetryModel.SetDefaultOrder("Time DESC")
+
+	aggregateModel := h.TelemetryAggregate().DeclareModel()
+	aggregateModel.AddFields(map[string]models.FieldDefinition{
+		"Device": models.Many2OneField{String: "Device", RelationModel: h.Device(),
+			Required: true, Index: true, OnDelete: models.Cascade},
+		"Metric": models.CharField{String: "Metric", Required: true, Index: true},
+		"Period": models.SelectionField{String: "Period", Required: true, Index: true,
+			Selection: types.Selection{"hour": "Hour", "day": "Day"}},
+		"Start": models.DateTimeField{String: "Start", Required: true, Index: true},
+		"Count": models.IntegerField{String: "Count", GoType: new(int64)},
+		"Min":   models.FloatField{String: "Minimum"},
+		"Max":   models.FloatField{String: "Maximum"},
+		"Sum":   models.FloatField{String: "Sum"},
+		"Avg":   models.FloatField{String: "Average"},
+	})
+	aggregateModel.SetDefaultOrder("Start DESC")
+}
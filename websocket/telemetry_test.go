@@ -0,0 +1,87 @@
+package websocket
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTelemetryValidate(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	ms := func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+	schema := &telemetrySchema{metrics: map[string]telemetryBound{
+		"temperature": {min: -40, max: 85},
+		"count":       {},
+	}}
+	tests := []struct {
+		name    string
+		schema  *telemetrySchema
+		reading TelemetryReading
+		ok      bool
+	}{
+		{"valid", schema, TelemetryReading{"temperature", 21.5, ms(now)}, true},
+		{"past", schema, TelemetryReading{"temperature", 21.5, ms(now.AddDate(0, 0, -3))}, true},
+		{"small skew", schema, TelemetryReading{"temperature", 21.5, ms(now.Add(30 * time.Second))}, true},
+		{"future", schema, TelemetryReading{"temperature", 21.5, ms(now.Add(time.Hour))}, false},
+		{"zero time", schema, TelemetryReading{"temperature", 21.5, 0}, false},
+		{"negative time", schema, TelemetryReading{"temperature", 21.5, -1}, false},
+		{"empty metric", schema, TelemetryReading{"", 1, ms(now)}, false},
+		{"unknown metric", schema, TelemetryReading{"humidity", 1, ms(now)}, false},
+		{"below range", schema, TelemetryReading{"temperature", -41, ms(now)}, false},
+		{"above range", schema, TelemetryReading{"temperature", 86, ms(now)}, false},
+		{"unbounded metric", schema, TelemetryReading{"count", 1e9, ms(now)}, true},
+		{"no schema", &telemetrySchema{}, TelemetryReading{"anything", 1, ms(now)}, true},
+		{"no schema zero time", &telemetrySchema{}, TelemetryReading{"anything", 1, 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.schema.validate(&tt.reading, now)
+			if (err == nil) != tt.ok {
+				t.Errorf("validate(%+v) = %v, want ok %v", tt.reading, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTelemetryWindows(t *testing.T) {
+	at := func(day, hour int) time.Time { return time.Date(2026, 3, day, hour, 0, 0, 0, time.UTC) }
+	window := func(period string, start time.Time) telemetryWindow {
+		if period == "hour" {
+			return telemetryWindow{period: period, start: start, end: start.Add(time.Hour)}
+		}
+		return telemetryWindow{period: period, start: start, end: start.AddDate(0, 0, 1)}
+	}
+	tests := []struct {
+		name  string
+		hours []time.Time
+		want  []telemetryWindow
+	}{
+		{"none", nil, nil},
+		{"one hour", []time.Time{at(1, 10)}, []telemetryWindow{window("hour", at(1, 10)), window("day", at(1, 0))}},
+		{"same day", []time.Time{at(1, 23), at(1, 0)}, []telemetryWindow{
+			window("hour", at(1, 0)), window("hour", at(1, 23)), window("day", at(1, 0))}},
+		{"two days", []time.Time{at(2, 1), at(1, 23)}, []telemetryWindow{
+			window("hour", at(1, 23)), window("hour", at(2, 1)), window("day", at(1, 0)), window("day", at(2, 0))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := telemetryWindows(tt.hours); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("telemetryWindows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTelemetryHours(t *testing.T) {
+	takeTelemetryHours()
+	base := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	markTelemetryHours(base.Add(5*time.Minute), base.Add(59*time.Minute), base.Add(61*time.Minute))
+	hours := takeTelemetryHours()
+	want := []time.Time{base, base.Add(time.Hour)}
+	if got := telemetryWindows(hours); len(got) != 3 || !got[0].start.Equal(want[0]) || !got[1].start.Equal(want[1]) {
+		t.Errorf("marked hours = %v, want %v", hours, want)
+	}
+	if again := takeTelemetryHours(); len(again) != 0 {
+		t.Errorf("takeTelemetryHours() = %v after take, want none", again)
+	}
+}
@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"encoding/binary"
+
+	"github.com/oklog/ulid"
+)
+
+const (
+	// transferIDSize is the size of the transfer ID at the start of
+	// binary transfer frames
+	transferIDSize = 26
+	// transferHeaderSize is the size of the header of binary transfer frames:
+	// the transfer ID followed by the big endian offset of the data.
+	transferHeaderSize = transferIDSize + 8
+)
+
+// encodeTransferFrame returns a binary transfer frame holding the given data
+// of transfer id at the given offset.
+func encodeTransferFrame(id string, offset int64, data []byte) []byte {
+	frame := make([]byte, transferHeaderSize+len(data))
+	copy(frame, id)
+	binary.BigEndian.PutUint64(frame[transferIDSize:], uint64(offset))
+	copy(frame[transferHeaderSize:], data)
+	return frame
+}
+
+// decodeTransferFrame splits the given binary frame into its transfer ID,
+// offset and data. ok is false if msg is not a transfer frame.
+func decodeTransferFrame(msg []byte) (id string, offset int64, data []byte, ok bool) {
+	if len(msg) < transferHeaderSize {
+		return "", 0, nil, false
+	}
+	id = string(msg[:transferIDSize])
+	if _, err := ulid.Parse(id); err != nil {
+		return "", 0, nil, false
+	}
+	offset = int64(binary.BigEndian.Uint64(msg[transferIDSize:transferHeaderSize]))
+	return id, offset, msg[transferHeaderSize:], true
+}
+
+// HandleBinary processes a binary message received from the client. Binary
+// messages are either transfer frames or messages encoded with the binary
+// codec of the session.
+func (service *Service) HandleBinary(s *Session, msg []byte) {
+	id, offset, data, ok := decodeTransferFrame(msg)
+	if !ok && s.Codec().Binary() {
+		service.handleMessage(s, s.Codec(), msg)
+		return
+	}
+	if !ok {
+		log.Info("Unknown binary frame", "service", service.Name, "session", s.SID, "size", len(msg))
+		return
+	}
+	if up := getUpload(id); up != nil {
+		up.receive(s, offset, data)
+		return
+	}
+	log.Info("Binary frame for unknown transfer", "service", service.Name, "session", s.SID, "transfer", id)
+}
@@ -0,0 +1,48 @@
+package websocket
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTransferFrame(t *testing.T) {
+	id := NewULID()
+	tests := []struct {
+		name   string
+		offset int64
+		data   []byte
+	}{
+		{"empty", 0, nil},
+		{"first chunk", 0, []byte("hello")},
+		{"large offset", 1 << 40, []byte{0, 1, 2, 255}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := encodeTransferFrame(id, tt.offset, tt.data)
+			if len(frame) != transferHeaderSize+len(tt.data) {
+				t.Fatalf("frame size = %d, want %d", len(frame), transferHeaderSize+len(tt.data))
+			}
+			gotID, offset, data, ok := decodeTransferFrame(frame)
+			if !ok {
+				t.Fatal("decodeTransferFrame() failed")
+			}
+			if gotID != id || offset != tt.offset || !bytes.Equal(data, tt.data) {
+				t.Errorf("decodeTransferFrame() = %q, %d, %v, want %q, %d, %v",
+					gotID, offset, data, id, tt.offset, tt.data)
+			}
+		})
+	}
+}
+
+func TestDecodeTransferFrameInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":     nil,
+		"too short": []byte("01ARZ3NDEKTSV4RRFFQ69G5FAV"),
+		"not ulid":  append([]byte("{\"jsonrpc\":\"2.0\",\"method\":"), make([]byte, 16)...),
+	}
+	for name, msg := range tests {
+		if _, _, _, ok := decodeTransferFrame(msg); ok {
+			t.Errorf("decodeTransferFrame(%s) accepted an invalid frame", name)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package websocket
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/server"
+	"github.com/hexya-erp/pool/h"
+)
+
+const (
+	// DefaultMaxUploadSize is the default maximum size of uploaded files
+	DefaultMaxUploadSize int64 = 32 << 20
+	// UploadChunkSize is the chunk size advised to clients
+	UploadChunkSize = 32 << 10
+	// UploadExpiry is the duration after which an idle upload is discarded
+	UploadExpiry = time.Hour
+	// UploadProgressInterval is the minimum time between two upload_progress
+	// notifications of an upload
+	UploadProgressInterval = 500 * time.Millisecond
+	// uploadExpiryInterval is the period of the checks of idle uploads
+	uploadExpiryInterval = time.Minute
+)
+
+// UploadParams is the format of the parameters of upload_begin
+type UploadParams struct {
+	UploadID string `json:"upload_id"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimetype"`
+	Model    string `json:"model"`
+	ID       int64  `json:"id"`
+	Checksum string `json:"checksum"`
+}
+
+// UploadStatus is the result of upload_begin and the params of the
+// upload_progress, upload_done and upload_error notifications
+type UploadStatus struct {
+	UploadID     string `json:"upload_id"`
+	Offset       int64  `json:"offset"`
+	Size         int64  `json:"size"`
+	ChunkSize    int    `json:"chunk_size,omitempty"`
+	AttachmentID int64  `json:"attachment_id,omitempty"`
+	Checksum     string `json:"checksum,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// An upload is a file being received from a client in binary frames
+type upload struct {
+	sync.Mutex
+	UploadParams
+	uid      int64
+	received int64
+	path     string
+	updated  time.Time
+	notified time.Time
+	hash     hash.Hash
+}
+
+var uploads sync.Map
+
+// getUpload returns the upload with the given id or nil
+func getUpload(id string) *upload {
+	if up, ok := uploads.Load(id); ok {
+		return up.(*upload)
+	}
+	return nil
+}
+
+// removeUpload discards the given upload and its temporary file
+func removeUpload(up *upload) {
+	uploads.Delete(up.UploadID)
+	os.Remove(up.path)
+}
+
+// expireUploads discards uploads that have been idle for UploadExpiry
+func expireUploads() {
+	uploads.Range(func(key, value interface{}) bool {
+		up := value.(*upload)
+		up.Lock()
+		expired := time.Since(up.updated) > UploadExpiry
+		up.Unlock()
+		if expired {
+			removeUpload(up)
+		}
+		return true
+	})
+}
+
+// startUploadExpiry starts the periodic checks of idle uploads
+func startUploadExpiry() {
+	go func() {
+		ticker := time.NewTicker(uploadExpiryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			expireUploads()
+		}
+	}()
+}
+
+// status returns the current status of the upload
+func (up *upload) status() *UploadStatus {
+	return &UploadStatus{
+		UploadID:  up.UploadID,
+		Offset:    up.received,
+		Size:      up.Size,
+		ChunkSize: UploadChunkSize,
+	}
+}
+
+// receive appends the given chunk to the upload. Chunks must be sent in
+// order: a chunk with an unexpected offset is rejected and the client is
+// told the offset to resume from.
+func (up *upload) receive(s *Session, offset int64, data []byte) {
+	up.Lock()
+	defer up.Unlock()
+	if s.UID != up.uid {
+		log.Warn("Upload chunk from another user", "upload", up.UploadID, "uid", s.UID)
+		return
+	}
+	if offset != up.received || up.received+int64(len(data)) > up.Size {
+		st := up.status()
+		st.Error = fmt.Sprintf("unexpected chunk at offset %d", offset)
+		s.Notify("upload_progress", st)
+		return
+	}
+	f, err := os.OpenFile(up.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = f.Write(data)
+		f.Close()
+	}
+	if err == nil {
+		up.hash.Write(data)
+	}
+	if err != nil {
+		removeUpload(up)
+		st := up.status()
+		st.Error = err.Error()
+		s.Notify("upload_error", st)
+		return
+	}
+	up.received += int64(len(data))
+	up.updated = time.Now()
+	if up.received < up.Size {
+		// Progress is throttled so that small chunks do not flood the client
+		if up.updated.Sub(up.notified) >= UploadProgressInterval {
+			up.notified = up.updated
+			s.Notify("upload_progress", up.status())
+		}
+		return
+	}
+	up.finish(s)
+}
+
+// finish checks the received file and stores it as an attachment of the
+// target record. The checksum is computed as the chunks are received and
+// the file is streamed into the base64 encoding of the attachment.
+func (up *upload) finish(s *Session) {
+	defer removeUpload(up)
+	st := up.status()
+	st.Checksum = hex.EncodeToString(up.hash.Sum(nil))
+	if up.Checksum != "" && up.Checksum != st.Checksum {
+		st.Error = "checksum mismatch"
+		s.Notify("upload_error", st)
+		return
+	}
+	datas, err := encodeFile(up.path, up.received)
+	if err != nil {
+		st.Error = err.Error()
+		s.Notify("upload_error", st)
+		return
+	}
+	err = models.ExecuteInNewEnvironment(up.uid, func(env models.Environment) {
+		attachment := h.Attachment().Create(env, &h.AttachmentData{
+			Name:       up.Name,
+			DatasFname: up.Name,
+			MimeType:   up.MimeType,
+			ResModel:   up.Model,
+			ResID:      up.ID,
+			Datas:      datas,
+		})
+		st.AttachmentID = attachment.ID()
+	})
+	if err != nil {
+		st.Error = err.Error()
+		s.Notify("upload_error", st)
+		return
+	}
+	s.Notify("upload_done", st)
+}
+
+// encodeFile returns the base64 encoding of the file at path, whose size is
+// given, without loading the raw file in memory.
+func encodeFile(path string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var buf strings.Builder
+	buf.Grow(base64.StdEncoding.EncodedLen(int(size)))
+	enc := base64.NewEncoder(base64.StdEncoding, &buf)
+	if _, err = io.Copy(enc, f); err != nil {
+		return "", err
+	}
+	if err = enc.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// checkRecordAccess panics if the user of env cannot read the record of
+// the given model with the given id.
+func checkRecordAccess(env models.Environment, model string, id int64) {
+	rc := env.Pool(model)
+	if rc.Search(rc.Model().Field("ID").Equals(id)).IsEmpty() {
+		log.Panic("Record not found", "model", model, "id", id)
+	}
+}
+
+// JsonRPCUploadBegin starts or resumes a file upload. The client then sends
+// the file content in binary frames made of the upload ID, the big endian
+// offset of the chunk on 8 bytes and the chunk data.
+//
+// When the upload is complete, the file is stored as an attachment of the
+// given record.
+func JsonRPCUploadBegin(s *Session, r *RequestRPC) (interface{}, error) {
+	uid := s.UID
+	if uid == 0 {
+		return NewResponseError(r, ErrorCodeAccessDenied, ErrAccessDenied.Error(), nil), nil
+	}
+	var params UploadParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return nil, errors.New("JsonRPCUploadBegin error: Invalid format")
+	}
+
+	if params.UploadID != "" {
+		up := getUpload(params.UploadID)
+		if up == nil || up.uid != uid {
+			return NewResponseError(r, ErrorCodeNotFound, "Upload not found: "+params.UploadID, nil), nil
+		}
+		up.Lock()
+		up.updated = time.Now()
+		st := up.status()
+		up.Unlock()
+		return &server.ResponseRPC{
+			JsonRPC: r.JsonRPC,
+			ID:      r.ID,
+			Result:  st,
+		}, nil
+	}
+
+	if params.Name == "" || params.Model == "" || params.ID == 0 || params.Size <= 0 {
+		return NewResponseError(r, ErrorCodeInvalidParams, "name, size, model and id are required", nil), nil
+	}
+	if params.Size > s.Service.MaxUploadSize {
+		msg := fmt.Sprintf("File too large: %d bytes (max %d)", params.Size, s.Service.MaxUploadSize)
+		return NewResponseError(r, ErrorCodeInvalidParams, msg, nil), nil
+	}
+	err = models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		checkRecordAccess(env, params.Model, params.ID)
+	})
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+
+	f, err := ioutil.TempFile("", "hexya-upload-")
+	if err != nil {
+		return NewExecutionError(s, r, err), nil
+	}
+	f.Close()
+	params.UploadID = NewULID()
+	up := &upload{
+		UploadParams: params,
+		uid:          uid,
+		path:         f.Name(),
+		updated:      time.Now(),
+		hash:         sha256.New(),
+	}
+	uploads.Store(up.UploadID, up)
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  up.status(),
+	}, nil
+}
+
+// JsonRPCUploadCancel discards an upload
+func JsonRPCUploadCancel(s *Session, r *RequestRPC) (interface{}, error) {
+	var params UploadParams
+	err := json.Unmarshal(*r.Params, &params)
+	if err != nil {
+		return nil, errors.New("JsonRPCUploadCancel error: Invalid format")
+	}
+	up := getUpload(params.UploadID)
+	if up == nil || up.uid != s.UID {
+		return NewResponseError(r, ErrorCodeNotFound, "Upload not found: "+params.UploadID, nil), nil
+	}
+	removeUpload(up)
+	return &server.ResponseRPC{
+		JsonRPC: r.JsonRPC,
+		ID:      r.ID,
+		Result:  true,
+	}, nil
+}
@@ -0,0 +1,28 @@
+package websocket
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEncodeFile(t *testing.T) {
+	tests := []string{"", "a", "ab", "abc", "hello, world\n"}
+	for _, content := range tests {
+		f, err := ioutil.TempFile("", "hexya-upload-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(content)
+		f.Close()
+		got, err := encodeFile(f.Name(), int64(len(content)))
+		os.Remove(f.Name())
+		if err != nil {
+			t.Fatalf("encodeFile(%q) error = %v", content, err)
+		}
+		if want := base64.StdEncoding.EncodeToString([]byte(content)); got != want {
+			t.Errorf("encodeFile(%q) = %q, want %q", content, got, want)
+		}
+	}
+}